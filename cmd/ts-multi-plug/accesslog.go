@@ -0,0 +1,280 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// combinedTimeFormat is the timestamp layout of the Apache combined format
+const combinedTimeFormat = "02/Jan/2006:15:04:05 -0700"
+
+// requestInfoKey is the context key of the *requestInfo of a request
+type requestInfoKey struct{}
+
+// requestInfo is the caller identity of a request, filled in by the WhoIs
+// handler for the access log
+type requestInfo struct {
+	remote string
+	login  string
+	node   string
+	funnel bool
+}
+
+// withRequestInfo returns a copy of r that carries info in its context
+func withRequestInfo(r *http.Request, info *requestInfo) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), requestInfoKey{}, info))
+}
+
+// requestInfoFrom returns the requestInfo of the request ctx belongs to, or
+// nil when access logging is disabled
+func requestInfoFrom(ctx context.Context) *requestInfo {
+	info, _ := ctx.Value(requestInfoKey{}).(*requestInfo)
+	return info
+}
+
+// logAccess writes the access log entry of a finished request
+func logAccess(r *http.Request, listener string, rec *statusRecorder, duration time.Duration, info *requestInfo) {
+	attrs := []slog.Attr{
+		slog.String("listener", listener),
+		slog.String("remote", info.remote),
+		slog.String("method", r.Method),
+		slog.String("path", r.URL.Path),
+	}
+	if r.URL.RawQuery != "" {
+		attrs = append(attrs, slog.String("query", r.URL.RawQuery))
+	}
+	attrs = append(attrs,
+		slog.String("proto", r.Proto),
+		slog.Int("status", rec.code),
+		slog.Int64("bytes", rec.bytes),
+		slog.Float64("duration_ms", float64(duration.Microseconds())/1000),
+		slog.String("login", info.login),
+		slog.String("node", info.node),
+		slog.Bool("funnel", info.funnel),
+		slog.String("referer", r.Referer()),
+		slog.String("user_agent", r.UserAgent()),
+	)
+	accessLog.LogAttrs(r.Context(), slog.LevelInfo, "access", attrs...)
+}
+
+// newAccessLogger creates the logger for -access-log. dest is stdout,
+// stderr or a file path. Files are rotated once they grow past maxSize
+// megabytes, keeping maxBackups old files.
+func newAccessLogger(dest, format string, maxSize, maxBackups int) (*slog.Logger, error) {
+	if err := validateAccessLogFormat(format); err != nil {
+		return nil, err
+	}
+
+	var w io.Writer
+	switch dest {
+	case "stdout":
+		w = os.Stdout
+	case "stderr":
+		w = os.Stderr
+	default:
+		f, err := openRotatingFile(dest, int64(maxSize)*1024*1024, maxBackups)
+		if err != nil {
+			return nil, err
+		}
+		w = f
+	}
+
+	switch format {
+	case "json":
+		return slog.New(slog.NewJSONHandler(w, nil)), nil
+	case "combined":
+		return slog.New(&combinedHandler{w: w}), nil
+	default:
+		return slog.New(slog.NewTextHandler(w, nil)), nil
+	}
+}
+
+// sameLogFile reports whether the log destinations a and b are the same
+// file. They would be rotated twice, stdout and stderr can be shared.
+func sameLogFile(a, b string) bool {
+	if a == "" || b == "" || a == "stdout" || a == "stderr" {
+		return false
+	}
+	absA, errA := filepath.Abs(a)
+	absB, errB := filepath.Abs(b)
+	if errA != nil || errB != nil {
+		return filepath.Clean(a) == filepath.Clean(b)
+	}
+	return absA == absB
+}
+
+// validateAccessLogFormat checks an -access-log-format value
+func validateAccessLogFormat(format string) error {
+	switch format {
+	case "json", "logfmt", "combined":
+		return nil
+	default:
+		return fmt.Errorf("unknown access log format %q, expected json, logfmt or combined", format)
+	}
+}
+
+// combinedHandler is a slog.Handler that writes access log records in the
+// Apache combined log format. The tailnet login takes the place of the
+// authenticated user.
+type combinedHandler struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (h *combinedHandler) Enabled(context.Context, slog.Level) bool {
+	return true
+}
+
+func (h *combinedHandler) WithAttrs([]slog.Attr) slog.Handler {
+	return h
+}
+
+func (h *combinedHandler) WithGroup(string) slog.Handler {
+	return h
+}
+
+func (h *combinedHandler) Handle(_ context.Context, rec slog.Record) error {
+	attrs := make(map[string]string, rec.NumAttrs())
+	rec.Attrs(func(a slog.Attr) bool {
+		attrs[a.Key] = a.Value.String()
+		return true
+	})
+	field := func(key string) string {
+		if v := attrs[key]; v != "" && v != "0" {
+			return v
+		}
+		return "-"
+	}
+
+	host := field("remote")
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	uri := attrs["path"]
+	if q := attrs["query"]; q != "" {
+		uri += "?" + q
+	}
+
+	line := fmt.Sprintf("%s - %s [%s] %q %s %s %q %q\n",
+		host,
+		field("login"),
+		rec.Time.Format(combinedTimeFormat),
+		attrs["method"]+" "+uri+" "+attrs["proto"],
+		field("status"),
+		field("bytes"),
+		field("referer"),
+		field("user_agent"),
+	)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	_, err := io.WriteString(h.w, line)
+	return err
+}
+
+// rotatingFile is an append-only log file that is renamed to path.1 once it
+// reaches maxSize bytes. Older files shift up to path.<maxBackups> and
+// anything beyond that is deleted.
+type rotatingFile struct {
+	path       string
+	maxSize    int64 // 0 disables rotation
+	maxBackups int
+
+	mu           sync.Mutex
+	f            *os.File
+	size         int64
+	rotateFailed bool // warned about a failed rotation
+}
+
+// openRotatingFile opens or creates the log file at path
+func openRotatingFile(path string, maxSize int64, maxBackups int) (*rotatingFile, error) {
+	rf := &rotatingFile{path: path, maxSize: maxSize, maxBackups: maxBackups}
+	if err := rf.open(); err != nil {
+		return nil, err
+	}
+	return rf, nil
+}
+
+func (rf *rotatingFile) open() error {
+	f, err := os.OpenFile(rf.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open log file: %w", err)
+	}
+	st, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("failed to stat log file: %w", err)
+	}
+	rf.f = f
+	rf.size = st.Size()
+	return nil
+}
+
+func (rf *rotatingFile) Write(p []byte) (int, error) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+
+	if rf.maxSize > 0 && rf.size > 0 && rf.size+int64(len(p)) > rf.maxSize {
+		if err := rf.rotate(); err != nil {
+			// keep writing to the current file and try again once another
+			// maxSize bytes have been written
+			if !rf.rotateFailed {
+				slog.Warn("failed to rotate log file, writing to the current file", "path", rf.path, "error", err)
+				rf.rotateFailed = true
+			}
+			rf.size = 0
+		} else {
+			rf.rotateFailed = false
+		}
+	}
+	n, err := rf.f.Write(p)
+	rf.size += int64(n)
+	return n, err
+}
+
+// rotate shifts the backups, moves the current file to path.1 and opens a
+// new file. The current file stays open until the new one is, so a failed
+// rotation leaves rf writable.
+func (rf *rotatingFile) rotate() error {
+	backup := func(i int) string {
+		return rf.path + "." + strconv.Itoa(i)
+	}
+	if rf.maxBackups > 0 {
+		if err := os.Remove(backup(rf.maxBackups)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("failed to remove old log file: %w", err)
+		}
+	}
+	for i := rf.maxBackups - 1; i >= 1; i-- {
+		if err := os.Rename(backup(i), backup(i+1)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("failed to rotate log file: %w", err)
+		}
+	}
+	if rf.maxBackups > 0 {
+		if err := os.Rename(rf.path, backup(1)); err != nil {
+			return fmt.Errorf("failed to rotate log file: %w", err)
+		}
+	} else if err := os.Remove(rf.path); err != nil {
+		return fmt.Errorf("failed to remove log file: %w", err)
+	}
+
+	old := rf.f
+	if err := rf.open(); err != nil {
+		return err
+	}
+	old.Close()
+	return nil
+}
@@ -0,0 +1,199 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	// assertionKeyFile is the name of the signing key file in the state directory
+	assertionKeyFile = "ts-plug-assertion.key"
+
+	// jwksFile is the name of the public key set written next to the signing key
+	jwksFile = "ts-plug-jwks.json"
+
+	// defaultJWKSPath is where the public key set is served on the HTTP and
+	// HTTPS listeners. It is namespaced so it doesn't shadow a JWKS the
+	// upstream serves itself at /.well-known/jwks.json.
+	defaultJWKSPath = "/.well-known/ts-plug/jwks.json"
+)
+
+// assertionSigner mints short-lived Ed25519 JWTs carrying the WhoIs result
+// so upstreams can verify the identity headers came from ts-plug
+type assertionSigner struct {
+	key    ed25519.PrivateKey
+	kid    string
+	ttl    time.Duration
+	issuer string // set once the tailnet hostname is known
+}
+
+// assertionClaims are the claims in an identity assertion
+type assertionClaims struct {
+	Issuer    string `json:"iss"`
+	Subject   string `json:"sub"`
+	IssuedAt  int64  `json:"iat"`
+	NotBefore int64  `json:"nbf"`
+	Expires   int64  `json:"exp"`
+
+	Login      string   `json:"login,omitempty"`
+	Name       string   `json:"name,omitempty"`
+	ProfilePic string   `json:"picture,omitempty"`
+	NodeName   string   `json:"node,omitempty"`
+	NodeID     string   `json:"node_id,omitempty"`
+	NodeIP     string   `json:"node_ip,omitempty"`
+	Tags       []string `json:"tags,omitempty"`
+}
+
+// loadAssertionSigner loads the signing key from dir, creating it on first
+// use, and writes the matching public key set next to it
+func loadAssertionSigner(dir string, ttl time.Duration) (*assertionSigner, error) {
+	if ttl <= 0 {
+		return nil, errors.New("assertion ttl must be positive")
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create state directory: %w", err)
+	}
+
+	path := filepath.Join(dir, assertionKeyFile)
+	key, err := readAssertionKey(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		key, err = createAssertionKey(path)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	pub := key.Public().(ed25519.PublicKey)
+	sum := sha256.Sum256(pub)
+	s := &assertionSigner{
+		key: key,
+		kid: base64.RawURLEncoding.EncodeToString(sum[:8]),
+		ttl: ttl,
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, jwksFile), s.jwks(), 0644); err != nil {
+		return nil, fmt.Errorf("failed to write %s: %w", jwksFile, err)
+	}
+	return s, nil
+}
+
+// readAssertionKey reads a PEM encoded PKCS #8 Ed25519 private key
+func readAssertionKey(path string) (ed25519.PrivateKey, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data in %s", path)
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+	key, ok := parsed.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s is not an Ed25519 key", path)
+	}
+	return key, nil
+}
+
+// createAssertionKey generates a new Ed25519 key and saves it to path
+func createAssertionKey(path string) (ed25519.PrivateKey, error) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	b := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	if err := os.WriteFile(path, b, 0600); err != nil {
+		return nil, fmt.Errorf("failed to save assertion key: %w", err)
+	}
+
+	slog.Info("created identity assertion signing key", "path", path)
+	return key, nil
+}
+
+// sign returns a signed JWT for the claims, filling in the issuer and
+// validity period
+func (s *assertionSigner) sign(claims assertionClaims) (string, error) {
+	now := time.Now()
+	claims.Issuer = s.issuer
+	claims.IssuedAt = now.Unix()
+	claims.NotBefore = now.Unix()
+	claims.Expires = now.Add(s.ttl).Unix()
+
+	header, err := json.Marshal(map[string]string{
+		"alg": "EdDSA",
+		"typ": "JWT",
+		"kid": s.kid,
+	})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	sig := ed25519.Sign(s.key, []byte(signingInput))
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+// jwks returns the JSON Web Key Set with the public signing key
+func (s *assertionSigner) jwks() []byte {
+	pub := s.key.Public().(ed25519.PublicKey)
+	b, _ := json.Marshal(map[string]any{
+		"keys": []map[string]string{{
+			"kty": "OKP",
+			"crv": "Ed25519",
+			"alg": "EdDSA",
+			"use": "sig",
+			"kid": s.kid,
+			"x":   base64.RawURLEncoding.EncodeToString(pub),
+		}},
+	})
+	return b
+}
+
+// withJWKS serves the public key set at path and passes every other
+// request to next. The path never reaches the upstream. Funnel requests are
+// subject to -funnel-allow-path like any other path.
+func (s *assertionSigner) withJWKS(path string, next http.Handler) http.Handler {
+	jwks := s.jwks()
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != path {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if _, isFunnel := funnelSource(r.Context()); isFunnel && !funnelPathAllowed(r.URL.Path) {
+			serveForbidden(w)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "max-age=300")
+		w.Write(jwks)
+	})
+}
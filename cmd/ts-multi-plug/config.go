@@ -0,0 +1,341 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mostlygeek/ts-plug/internal/tsauth"
+	"github.com/tailscale/hujson"
+)
+
+// Config is the format of the -config file. The file is HuJSON (JSON with
+// comments and trailing commas). Every field is optional and corresponds to a
+// command line flag. Flags given on the command line take precedence over the
+// values in the file.
+type Config struct {
+	Hostname   string `json:"hostname,omitempty"`
+	Dir        string `json:"dir,omitempty"`
+	LogLevel   string `json:"logLevel,omitempty"`
+	DebugTSNet *bool  `json:"debugTSNet,omitempty"`
+
+	AuthKey       string `json:"authKey,omitempty"`
+	ClientSecret  string `json:"clientSecret,omitempty"`
+	AdvertiseTags string `json:"advertiseTags,omitempty"`
+	ControlURL    string `json:"controlURL,omitempty"`
+	Ephemeral     *bool  `json:"ephemeral,omitempty"`
+
+	// Listeners, each entry is a port mapping in the format "in:out" or "port"
+	HTTP  []string `json:"http,omitempty"`
+	HTTPS []string `json:"https,omitempty"`
+	DNS   string   `json:"dns,omitempty"`
+	TCP   []string `json:"tcp,omitempty"`
+
+	DNSCacheSize *int `json:"dnsCacheSize,omitempty"`
+	// DNSQueryLog is stdout, stderr or a file path
+	DNSQueryLog           string `json:"dnsQueryLog,omitempty"`
+	DNSQueryLogMaxSize    *int   `json:"dnsQueryLogMaxSize,omitempty"`
+	DNSQueryLogMaxBackups *int   `json:"dnsQueryLogMaxBackups,omitempty"`
+
+	Public *bool `json:"public,omitempty"`
+
+	// Funnel listeners are public, FunnelRoutes replaces Routes for them
+	Funnel       []string      `json:"funnel,omitempty"`
+	FunnelRoutes []ConfigRoute `json:"funnelRoutes,omitempty"`
+	FunnelOnly   *bool         `json:"funnelOnly,omitempty"`
+
+	// FunnelAllowPaths restricts public Funnel requests to these path prefixes
+	FunnelAllowPaths []string `json:"funnelAllowPaths,omitempty"`
+
+	Routes []ConfigRoute `json:"routes,omitempty"`
+
+	// Access control, see the -allow-* and -deny-* flags
+	AllowUsers  []string `json:"allowUsers,omitempty"`
+	AllowGroups []string `json:"allowGroups,omitempty"`
+	AllowTags   []string `json:"allowTags,omitempty"`
+	DenyUsers   []string `json:"denyUsers,omitempty"`
+	DenyGroups  []string `json:"denyGroups,omitempty"`
+	DenyTags    []string `json:"denyTags,omitempty"`
+
+	// AppCapabilities are forwarded in the Tailscale-App-Capabilities header
+	AppCapabilities []string `json:"appCapabilities,omitempty"`
+
+	IdentityAssertion    *bool  `json:"identityAssertion,omitempty"`
+	IdentityAssertionTTL string `json:"identityAssertionTTL,omitempty"`
+	// IdentityAssertionJWKSPath is where the public keys are served
+	IdentityAssertionJWKSPath string `json:"identityAssertionJWKSPath,omitempty"`
+
+	MetricsAddr string `json:"metricsAddr,omitempty"`
+
+	// AccessLog is stdout, stderr or a file path
+	AccessLog           string `json:"accessLog,omitempty"`
+	AccessLogFormat     string `json:"accessLogFormat,omitempty"`
+	AccessLogMaxSize    *int   `json:"accessLogMaxSize,omitempty"`
+	AccessLogMaxBackups *int   `json:"accessLogMaxBackups,omitempty"`
+
+	ReadyCheck    string `json:"readyCheck,omitempty"`
+	ReadyInterval string `json:"readyInterval,omitempty"`
+
+	Restart      string `json:"restart,omitempty"`
+	RestartMax   *int   `json:"restartMax,omitempty"`
+	RestartDelay string `json:"restartDelay,omitempty"`
+	GracePeriod  string `json:"gracePeriod,omitempty"`
+
+	// Command is run when no command is given after "--"
+	Command []string `json:"command,omitempty"`
+}
+
+// ConfigRoute is a path route in the config file
+type ConfigRoute struct {
+	Path  string `json:"path"`
+	Port  int    `json:"port"`
+	Strip bool   `json:"strip,omitempty"`
+}
+
+// loadConfig reads, parses and validates a config file
+func loadConfig(path string) (*Config, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config: %w", err)
+	}
+
+	b, err = hujson.Standardize(b)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse config %s: %w", path, err)
+	}
+
+	cfg := new(Config)
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(cfg); err != nil {
+		return nil, fmt.Errorf("failed to parse config %s: %w", path, err)
+	}
+
+	if err := cfg.validate(); err != nil {
+		return nil, fmt.Errorf("invalid config %s: %w", path, err)
+	}
+	return cfg, nil
+}
+
+// validate checks the values that are not validated when they are applied
+// to their flags
+func (c *Config) validate() error {
+	if c.LogLevel != "" {
+		if _, err := parseLogLevel(c.LogLevel); err != nil {
+			return fmt.Errorf("logLevel: %w", err)
+		}
+	}
+	if _, err := tsauth.ParseTags(c.AdvertiseTags); err != nil {
+		return fmt.Errorf("advertiseTags: %w", err)
+	}
+	if err := tsauth.ValidateControlURL(c.ControlURL); err != nil {
+		return fmt.Errorf("controlURL: %w", err)
+	}
+	if c.DNSCacheSize != nil && *c.DNSCacheSize < 0 {
+		return fmt.Errorf("dnsCacheSize: must not be negative")
+	}
+	if c.DNSQueryLogMaxSize != nil && *c.DNSQueryLogMaxSize < 0 {
+		return fmt.Errorf("dnsQueryLogMaxSize: must not be negative")
+	}
+	if c.DNSQueryLogMaxBackups != nil && *c.DNSQueryLogMaxBackups < 0 {
+		return fmt.Errorf("dnsQueryLogMaxBackups: must not be negative")
+	}
+	if c.MetricsAddr != "" {
+		if err := validateMetricsAddr(c.MetricsAddr); err != nil {
+			return fmt.Errorf("metricsAddr: %w", err)
+		}
+	}
+	if c.AccessLogFormat != "" {
+		if err := validateAccessLogFormat(c.AccessLogFormat); err != nil {
+			return fmt.Errorf("accessLogFormat: %w", err)
+		}
+	}
+	if c.AccessLogMaxSize != nil && *c.AccessLogMaxSize < 0 {
+		return fmt.Errorf("accessLogMaxSize: must not be negative")
+	}
+	if c.AccessLogMaxBackups != nil && *c.AccessLogMaxBackups < 0 {
+		return fmt.Errorf("accessLogMaxBackups: must not be negative")
+	}
+	if c.ReadyCheck != "" {
+		if _, err := newReadiness(c.ReadyCheck, time.Second); err != nil {
+			return fmt.Errorf("readyCheck: %w", err)
+		}
+	}
+	if c.Restart != "" {
+		if _, err := parseRestartPolicy(c.Restart); err != nil {
+			return fmt.Errorf("restart: %w", err)
+		}
+	}
+	if c.RestartMax != nil && *c.RestartMax < 0 {
+		return fmt.Errorf("restartMax: must not be negative")
+	}
+	for _, rules := range []struct {
+		field  string
+		prefix string
+		values []string
+	}{
+		{"allowGroups", "group:", c.AllowGroups},
+		{"denyGroups", "group:", c.DenyGroups},
+		{"allowTags", "tag:", c.AllowTags},
+		{"denyTags", "tag:", c.DenyTags},
+	} {
+		for i, v := range rules.values {
+			if !strings.HasPrefix(v, rules.prefix) {
+				return fmt.Errorf("%s[%d]: %q must be in the format %sname", rules.field, i, v, rules.prefix)
+			}
+		}
+	}
+	for i, p := range c.FunnelAllowPaths {
+		if !strings.HasPrefix(p, "/") {
+			return fmt.Errorf("funnelAllowPaths[%d]: must start with /: %s", i, p)
+		}
+	}
+	if err := validateRoutes("routes", c.Routes); err != nil {
+		return err
+	}
+	if err := validateRoutes("funnelRoutes", c.FunnelRoutes); err != nil {
+		return err
+	}
+	if len(c.Command) > 0 && c.Command[0] == "" {
+		return fmt.Errorf("command[0]: must not be empty")
+	}
+	return nil
+}
+
+// apply sets every flag that was not given on the command line from the
+// config. Errors name the config field that could not be applied.
+func (c *Config) apply() error {
+	onCLI := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		onCLI[f.Name] = true
+	})
+	if onCLI["hn"] {
+		onCLI["hostname"] = true
+	}
+
+	set := func(field, name, value string) error {
+		if value == "" || onCLI[name] {
+			return nil
+		}
+		if err := flag.Set(name, value); err != nil {
+			return fmt.Errorf("%s: %w", field, err)
+		}
+		return nil
+	}
+	setList := func(field, name string, values []string) error {
+		if onCLI[name] {
+			return nil
+		}
+		for i, v := range values {
+			if err := set(fmt.Sprintf("%s[%d]", field, i), name, v); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	setBool := func(field, name string, value *bool) error {
+		if value == nil {
+			return nil
+		}
+		return set(field, name, strconv.FormatBool(*value))
+	}
+	setInt := func(field, name string, value *int) error {
+		if value == nil {
+			return nil
+		}
+		return set(field, name, strconv.Itoa(*value))
+	}
+
+	errs := []error{
+		set("hostname", "hostname", c.Hostname),
+		set("dir", "dir", c.Dir),
+		set("logLevel", "log", c.LogLevel),
+		setBool("debugTSNet", "debug-tsnet", c.DebugTSNet),
+		set("authKey", "authkey", c.AuthKey),
+		set("clientSecret", "client-secret", c.ClientSecret),
+		set("advertiseTags", "advertise-tags", c.AdvertiseTags),
+		set("controlURL", "control-url", c.ControlURL),
+		setBool("ephemeral", "ephemeral", c.Ephemeral),
+		setList("http", "http-port", c.HTTP),
+		setList("https", "https-port", c.HTTPS),
+		set("dns", "dns-port", c.DNS),
+		setList("tcp", "tcp", c.TCP),
+		setInt("dnsCacheSize", "dns-cache-size", c.DNSCacheSize),
+		set("dnsQueryLog", "dns-query-log", c.DNSQueryLog),
+		setInt("dnsQueryLogMaxSize", "dns-query-log-max-size", c.DNSQueryLogMaxSize),
+		setInt("dnsQueryLogMaxBackups", "dns-query-log-max-backups", c.DNSQueryLogMaxBackups),
+		setBool("public", "public", c.Public),
+		setList("funnel", "funnel-port", c.Funnel),
+		setBool("funnelOnly", "funnel-only", c.FunnelOnly),
+		setList("funnelAllowPaths", "funnel-allow-path", c.FunnelAllowPaths),
+		setList("allowUsers", "allow-user", c.AllowUsers),
+		setList("allowGroups", "allow-group", c.AllowGroups),
+		setList("allowTags", "allow-tag", c.AllowTags),
+		setList("denyUsers", "deny-user", c.DenyUsers),
+		setList("denyGroups", "deny-group", c.DenyGroups),
+		setList("denyTags", "deny-tag", c.DenyTags),
+		setList("appCapabilities", "app-capability", c.AppCapabilities),
+		setBool("identityAssertion", "identity-assertion", c.IdentityAssertion),
+		set("identityAssertionTTL", "identity-assertion-ttl", c.IdentityAssertionTTL),
+		set("identityAssertionJWKSPath", "identity-assertion-jwks-path", c.IdentityAssertionJWKSPath),
+		set("metricsAddr", "metrics-addr", c.MetricsAddr),
+		set("accessLog", "access-log", c.AccessLog),
+		set("accessLogFormat", "access-log-format", c.AccessLogFormat),
+		setInt("accessLogMaxSize", "access-log-max-size", c.AccessLogMaxSize),
+		setInt("accessLogMaxBackups", "access-log-max-backups", c.AccessLogMaxBackups),
+		set("readyCheck", "ready-check", c.ReadyCheck),
+		set("readyInterval", "ready-interval", c.ReadyInterval),
+		set("restart", "restart", c.Restart),
+		setInt("restartMax", "restart-max", c.RestartMax),
+		set("restartDelay", "restart-delay", c.RestartDelay),
+		set("gracePeriod", "grace-period", c.GracePeriod),
+	}
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+
+	// -route and -route-strip share one list, either on the command line
+	// replaces all routes from the config. The same goes for -funnel-route.
+	setRoutes := func(field, name string, routes []ConfigRoute) error {
+		if onCLI[name] || onCLI[name+"-strip"] {
+			return nil
+		}
+		for i, rt := range routes {
+			flagName := name
+			if rt.Strip {
+				flagName = name + "-strip"
+			}
+			if err := set(fmt.Sprintf("%s[%d]", field, i), flagName, fmt.Sprintf("%s=%d", rt.Path, rt.Port)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := setRoutes("routes", "route", c.Routes); err != nil {
+		return err
+	}
+	return setRoutes("funnelRoutes", "funnel-route", c.FunnelRoutes)
+}
+
+// validateRoutes checks the routes of the config field named field
+func validateRoutes(field string, routes []ConfigRoute) error {
+	for i, rt := range routes {
+		if rt.Path == "" {
+			return fmt.Errorf("%s[%d].path: is required", field, i)
+		}
+		if rt.Port <= 0 || rt.Port > 65535 {
+			return fmt.Errorf("%s[%d].port: invalid port %d", field, i, rt.Port)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,284 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"tailscale.com/client/local"
+	"tailscale.com/ipn"
+	"tailscale.com/tsnet"
+)
+
+// dnsTCPIdleTimeout closes DNS over TCP connections that have no queries or
+// responses for this long
+const dnsTCPIdleTimeout = 10 * time.Second
+
+// startDNSListener starts the DNS forwarders on the tailnet, over UDP and
+// over TCP on the same port. Queries are logged with the identity of the
+// client looked up with lc.
+func startDNSListener(ctx context.Context, ts *tsnet.Server, lc *local.Client, hostname string, portMap *PortMapFlag) error {
+	queryLog := newDNSQueryLogger(ctx, lc)
+
+	errc := make(chan error, 2)
+	go func() {
+		errc <- startDNSUDPListener(ctx, ts, lc, hostname, portMap, queryLog)
+	}()
+	go func() {
+		errc <- startDNSTCPListener(ctx, ts, hostname, portMap, queryLog)
+	}()
+
+	for range 2 {
+		if err := <-errc; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// startDNSUDPListener starts a DNS packet forwarder on every Tailscale IP of
+// the node, IPv4 and IPv6. The node's addresses are followed on the IPN bus
+// so added addresses get a listener and the listeners of removed addresses
+// are closed. Addresses that can't be listened on are skipped until the next
+// update, it is an error only when no address can be.
+func startDNSUDPListener(ctx context.Context, ts *tsnet.Server, lc *local.Client, hostname string, portMap *PortMapFlag, queryLog *dnsQueryLogger) error {
+	watcher, err := lc.WatchIPNBus(ctx, ipn.NotifyInitialNetMap|ipn.NotifyNoPrivateKeys|ipn.NotifyRateLimit)
+	if err != nil {
+		return fmt.Errorf("failed to watch tailscale addresses: %w", err)
+	}
+	defer watcher.Close()
+
+	slog.Info(fmt.Sprintf("listening at (DNS): %s:%d -> 127.0.0.1:%d", hostname, portMap.In, portMap.Out))
+
+	var cache *dnsCache
+	if *flagDNSCacheSize > 0 {
+		cache = newDNSCache(*flagDNSCacheSize)
+	}
+	forwarder, err := newDNSForwarder(fmt.Sprintf("127.0.0.1:%d", portMap.Out), cache, queryLog)
+	if err != nil {
+		return err
+	}
+	defer forwarder.close()
+
+	// stops the read loop of each address
+	listeners := make(map[netip.Addr]context.CancelFunc)
+
+	for {
+		n, err := watcher.Next()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return fmt.Errorf("failed to watch tailscale addresses: %w", err)
+		}
+		if n.NetMap == nil {
+			continue
+		}
+
+		addrs := make(map[netip.Addr]bool)
+		for _, pfx := range n.NetMap.GetAddresses().All() {
+			addrs[pfx.Addr()] = true
+		}
+
+		for addr, stop := range listeners {
+			if !addrs[addr] {
+				slog.Info("DNS stopped listening on removed address", "addr", addr)
+				stop()
+				delete(listeners, addr)
+			}
+		}
+
+		for addr := range addrs {
+			if _, ok := listeners[addr]; ok {
+				continue
+			}
+
+			listenAddr := netip.AddrPortFrom(addr, uint16(portMap.In)).String()
+			tsConn, err := ts.ListenPacket("udp", listenAddr)
+			if err != nil {
+				// e.g. IPv6 is unavailable, the address is tried again on the
+				// next netmap update
+				slog.Warn("DNS failed to listen on address", "addr", listenAddr, "error", err)
+				continue
+			}
+			slog.Debug("DNS listening on address", "addr", listenAddr)
+
+			addrCtx, stop := context.WithCancel(ctx)
+			listeners[addr] = stop
+			go forwarder.serveUDP(addrCtx, tsConn)
+		}
+
+		if len(addrs) > 0 && len(listeners) == 0 {
+			return fmt.Errorf("failed to listen for DNS on any tailscale address")
+		}
+	}
+}
+
+// startDNSTCPListener starts a DNS over TCP forwarder on the tailnet. Clients
+// fall back to TCP for truncated responses and zone transfers.
+func startDNSTCPListener(ctx context.Context, ts *tsnet.Server, hostname string, portMap *PortMapFlag, queryLog *dnsQueryLogger) error {
+	listener, err := ts.Listen("tcp", fmt.Sprintf(":%d", portMap.In))
+	if err != nil {
+		return fmt.Errorf("failed to listen on DNS TCP port %d: %w", portMap.In, err)
+	}
+	defer listener.Close()
+
+	slog.Info(fmt.Sprintf("listening at (DNS TCP): %s:%d -> 127.0.0.1:%d", hostname, portMap.In, portMap.Out))
+
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
+
+	upstreamAddr := fmt.Sprintf("127.0.0.1:%d", portMap.Out)
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return fmt.Errorf("DNS TCP accept error: %w", err)
+		}
+		if !upstreamReady.Ready() {
+			slog.Debug("DNS TCP connection rejected, upstream not ready", "client", conn.RemoteAddr())
+			conn.Close()
+			continue
+		}
+		go handleDNSTCPConn(ctx, conn, upstreamAddr, queryLog)
+	}
+}
+
+// handleDNSTCPConn relays length prefixed DNS messages between a client and
+// the upstream over TCP. Each direction is relayed on its own so pipelined
+// queries and zone transfers with many response messages work. The
+// connection is closed once it has been idle for dnsTCPIdleTimeout.
+// Responses are matched to their queries by transaction ID for queryLog.
+func handleDNSTCPConn(ctx context.Context, conn net.Conn, upstreamAddr string, queryLog *dnsQueryLogger) {
+	defer conn.Close()
+
+	dialer := &net.Dialer{Timeout: 2 * time.Second}
+	upstreamConn, err := dialer.DialContext(ctx, "tcp", upstreamAddr)
+	if err != nil {
+		slog.Error("failed to connect to upstream DNS over TCP", "error", err, "upstream", upstreamAddr)
+		upstreamErrors.Add(upstreamLabels{Upstream: upstreamAddr}, 1)
+		return
+	}
+	defer upstreamConn.Close()
+
+	// close both sides on shutdown so the relays return
+	stop := context.AfterFunc(ctx, func() {
+		conn.Close()
+		upstreamConn.Close()
+	})
+	defer stop()
+
+	// any query or response keeps both directions alive
+	touch := func() {
+		deadline := time.Now().Add(dnsTCPIdleTimeout)
+		conn.SetReadDeadline(deadline)
+		upstreamConn.SetReadDeadline(deadline)
+	}
+	touch()
+
+	slog.Debug("DNS TCP connection opened", "client", conn.RemoteAddr())
+
+	// queries waiting for their first response, only kept with queryLog
+	type pendingQuery struct {
+		query []byte
+		start time.Time
+	}
+	var mu sync.Mutex
+	pending := make(map[uint16]pendingQuery)
+	client := addrOf(conn.RemoteAddr())
+
+	var wg sync.WaitGroup
+	wg.Go(func() {
+		defer closeWrite(upstreamConn)
+		for {
+			query, err := readDNSTCPMessage(conn)
+			if err != nil {
+				return
+			}
+			touch()
+			if queryLog != nil && len(query) >= dnsHeaderSize {
+				mu.Lock()
+				pending[binary.BigEndian.Uint16(query)] = pendingQuery{query: query, start: time.Now()}
+				mu.Unlock()
+			}
+			if err := writeDNSTCPMessage(upstreamConn, query); err != nil {
+				slog.Error("failed to write to upstream DNS over TCP", "error", err)
+				upstreamErrors.Add(upstreamLabels{Upstream: upstreamAddr}, 1)
+				return
+			}
+		}
+	})
+	wg.Go(func() {
+		defer closeWrite(conn)
+		for {
+			response, err := readDNSTCPMessage(upstreamConn)
+			if err != nil {
+				return
+			}
+			touch()
+			countDNSResponse(response)
+			if err := writeDNSTCPMessage(conn, response); err != nil {
+				slog.Debug("failed to write DNS TCP response to client", "error", err)
+				return
+			}
+			if queryLog != nil && len(response) >= dnsHeaderSize {
+				// zone transfers answer one query with many messages, only
+				// the first is logged
+				id := binary.BigEndian.Uint16(response)
+				mu.Lock()
+				q, ok := pending[id]
+				delete(pending, id)
+				mu.Unlock()
+				if ok {
+					queryLog.log(queryLog.finish(dnsQueryRecord{
+						client:    client,
+						transport: "tcp",
+						start:     q.start,
+					}, q.query, response))
+				}
+			}
+		}
+	})
+	wg.Wait()
+
+	slog.Debug("DNS TCP connection closed", "client", conn.RemoteAddr())
+}
+
+// readDNSTCPMessage reads one DNS message with its 2 byte length prefix
+func readDNSTCPMessage(r io.Reader) ([]byte, error) {
+	var length [2]byte
+	if _, err := io.ReadFull(r, length[:]); err != nil {
+		return nil, err
+	}
+	msg := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// writeDNSTCPMessage writes msg with its 2 byte length prefix in one write
+func writeDNSTCPMessage(w io.Writer, msg []byte) error {
+	if len(msg) > math.MaxUint16 {
+		return fmt.Errorf("DNS message too large: %d bytes", len(msg))
+	}
+	buf := make([]byte, 2+len(msg))
+	binary.BigEndian.PutUint16(buf, uint16(len(msg)))
+	copy(buf[2:], msg)
+	_, err := w.Write(buf)
+	return err
+}
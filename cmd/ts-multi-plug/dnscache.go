@@ -0,0 +1,284 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"expvar"
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+	"tailscale.com/util/lru"
+)
+
+const (
+	// dnsCacheMaxTTL caps how long any response is cached
+	dnsCacheMaxTTL = 24 * time.Hour
+
+	// dnsDefaultUDPSize is the largest UDP response a client without EDNS
+	// accepts
+	dnsDefaultUDPSize = 512
+)
+
+var (
+	dnsCacheHits   = newInt("counter_tsplug_dns_cache_hits")
+	dnsCacheMisses = newInt("counter_tsplug_dns_cache_misses")
+)
+
+// dnsCacheKey identifies the question a cached response answers. The EDNS
+// and DNSSEC bits of the query are part of the key since they change what
+// the upstream answers, e.g. CD=1 responses skip DNSSEC validation.
+type dnsCacheKey struct {
+	name  string // lower case
+	qtype dnsmessage.Type
+	class dnsmessage.Class
+	edns  bool // the query has an OPT record
+	do    bool // DNSSEC OK, RRSIGs are wanted
+	cd    bool // checking disabled, no DNSSEC validation
+}
+
+// dnsCacheQuery is the part of a query the cache needs
+type dnsCacheQuery struct {
+	id       uint16
+	question dnsmessage.Question
+	maxSize  int // largest UDP response the client accepts
+	key      dnsCacheKey
+}
+
+// dnsCacheEntry is a cached response
+type dnsCacheEntry struct {
+	msg     dnsmessage.Message
+	stored  time.Time
+	expires time.Time
+}
+
+// dnsCache is an LRU cache of upstream DNS responses. Responses are kept
+// for their smallest TTL, negative responses for the SOA minimum TTL as in
+// RFC 2308. A nil *dnsCache caches nothing.
+type dnsCache struct {
+	mu      sync.Mutex
+	entries *lru.Cache[dnsCacheKey, *dnsCacheEntry]
+}
+
+// newDNSCache creates a cache of up to size responses
+func newDNSCache(size int) *dnsCache {
+	c := &dnsCache{
+		entries: &lru.Cache[dnsCacheKey, *dnsCacheEntry]{MaxEntries: size},
+	}
+	metricsVars.Set("gauge_tsplug_dns_cache_entries", expvar.Func(func() any {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		return int64(c.entries.Len())
+	}))
+	return c
+}
+
+// get returns the cached response to query with the transaction ID of query
+// and TTLs lowered by the time spent in the cache
+func (c *dnsCache) get(query []byte) ([]byte, bool) {
+	if c == nil {
+		return nil, false
+	}
+	q, ok := parseDNSCacheQuery(query)
+	if !ok {
+		dnsCacheMisses.Add(1)
+		return nil, false
+	}
+	now := time.Now()
+
+	c.mu.Lock()
+	entry, ok := c.entries.GetOk(q.key)
+	if ok && !now.Before(entry.expires) {
+		c.entries.Delete(q.key)
+		ok = false
+	}
+	c.mu.Unlock()
+	if !ok {
+		dnsCacheMisses.Add(1)
+		return nil, false
+	}
+
+	// entries are never modified once stored, copy what is rewritten
+	msg := entry.msg
+	msg.Header.ID = q.id
+	msg.Questions = []dnsmessage.Question{q.question}
+	elapsed := uint32(now.Sub(entry.stored) / time.Second)
+	msg.Answers = agedResources(msg.Answers, elapsed)
+	msg.Authorities = agedResources(msg.Authorities, elapsed)
+	msg.Additionals = agedResources(msg.Additionals, elapsed)
+	if !q.key.edns {
+		// RFC 6891 section 7, no OPT record for clients that didn't send one
+		msg.Additionals = withoutOPT(msg.Additionals)
+	}
+
+	response, err := msg.Pack()
+	if err != nil || len(response) > q.maxSize {
+		// too large for this client, let the upstream truncate it
+		dnsCacheMisses.Add(1)
+		return nil, false
+	}
+	dnsCacheHits.Add(1)
+	return response, true
+}
+
+// put caches response if it is a cacheable answer to query
+func (c *dnsCache) put(query, response []byte) {
+	if c == nil {
+		return
+	}
+	q, ok := parseDNSCacheQuery(query)
+	if !ok {
+		return
+	}
+
+	var msg dnsmessage.Message
+	if err := msg.Unpack(response); err != nil {
+		return
+	}
+	if !msg.Header.Response || msg.Header.Truncated || len(msg.Questions) != 1 {
+		return
+	}
+	if !sameDNSQuestion(msg.Questions[0], q.question) {
+		return
+	}
+
+	ttl, ok := dnsCacheTTL(&msg)
+	if !ok || ttl == 0 {
+		return
+	}
+
+	now := time.Now()
+	entry := &dnsCacheEntry{
+		msg:     msg,
+		stored:  now,
+		expires: now.Add(min(time.Duration(ttl)*time.Second, dnsCacheMaxTTL)),
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries.Set(q.key, entry)
+}
+
+// sameDNSQuestion reports whether a and b ask the same question, names are
+// case insensitive
+func sameDNSQuestion(a, b dnsmessage.Question) bool {
+	return a.Type == b.Type && a.Class == b.Class &&
+		strings.EqualFold(a.Name.String(), b.Name.String())
+}
+
+// parseDNSCacheQuery parses a standard query with a single question
+func parseDNSCacheQuery(query []byte) (dnsCacheQuery, bool) {
+	var p dnsmessage.Parser
+	h, err := p.Start(query)
+	if err != nil || h.Response || h.OpCode != 0 {
+		return dnsCacheQuery{}, false
+	}
+	questions, err := p.AllQuestions()
+	if err != nil || len(questions) != 1 {
+		return dnsCacheQuery{}, false
+	}
+	if err := p.SkipAllAnswers(); err != nil {
+		return dnsCacheQuery{}, false
+	}
+	if err := p.SkipAllAuthorities(); err != nil {
+		return dnsCacheQuery{}, false
+	}
+
+	q := dnsCacheQuery{
+		id:       h.ID,
+		question: questions[0],
+		maxSize:  dnsDefaultUDPSize,
+		key: dnsCacheKey{
+			name:  strings.ToLower(questions[0].Name.String()),
+			qtype: questions[0].Type,
+			class: questions[0].Class,
+			cd:    h.CheckingDisabled,
+		},
+	}
+	for {
+		rh, err := p.AdditionalHeader()
+		if err == dnsmessage.ErrSectionDone {
+			break
+		}
+		if err != nil {
+			return dnsCacheQuery{}, false
+		}
+		if rh.Type == dnsmessage.TypeOPT {
+			// the class of an OPT record is the client's UDP payload size
+			q.maxSize = max(int(rh.Class), dnsDefaultUDPSize)
+			q.key.edns = true
+			q.key.do = rh.DNSSECAllowed()
+		}
+		if err := p.SkipAdditional(); err != nil {
+			return dnsCacheQuery{}, false
+		}
+	}
+	return q, true
+}
+
+// dnsCacheTTL returns how many seconds msg may be cached. Positive answers
+// use their smallest record TTL. Negative answers, NXDOMAIN or an empty
+// answer, use the SOA record in the authority section, the smaller of its
+// TTL and minimum TTL. Anything else is not cached.
+func dnsCacheTTL(msg *dnsmessage.Message) (uint32, bool) {
+	switch msg.Header.RCode {
+	case dnsmessage.RCodeSuccess:
+		if len(msg.Answers) > 0 {
+			return minTTL(msg.Answers, msg.Authorities), true
+		}
+	case dnsmessage.RCodeNameError:
+	default:
+		return 0, false
+	}
+
+	for _, rr := range msg.Authorities {
+		if soa, ok := rr.Body.(*dnsmessage.SOAResource); ok {
+			return min(rr.Header.TTL, soa.MinTTL), true
+		}
+	}
+	return 0, false
+}
+
+// minTTL returns the smallest TTL of the records in sections
+func minTTL(sections ...[]dnsmessage.Resource) uint32 {
+	ttl := uint32(math.MaxUint32)
+	for _, rrs := range sections {
+		for _, rr := range rrs {
+			if rr.Header.Type != dnsmessage.TypeOPT {
+				ttl = min(ttl, rr.Header.TTL)
+			}
+		}
+	}
+	return ttl
+}
+
+// withoutOPT returns rrs without OPT records
+func withoutOPT(rrs []dnsmessage.Resource) []dnsmessage.Resource {
+	var out []dnsmessage.Resource
+	for _, rr := range rrs {
+		if rr.Header.Type != dnsmessage.TypeOPT {
+			out = append(out, rr)
+		}
+	}
+	return out
+}
+
+// agedResources returns a copy of rrs with elapsed seconds taken off each
+// TTL. OPT records carry flags in their TTL and are left alone.
+func agedResources(rrs []dnsmessage.Resource, elapsed uint32) []dnsmessage.Resource {
+	if len(rrs) == 0 {
+		return rrs
+	}
+	aged := make([]dnsmessage.Resource, len(rrs))
+	copy(aged, rrs)
+	for i := range aged {
+		if aged[i].Header.Type == dnsmessage.TypeOPT {
+			continue
+		}
+		aged[i].Header.TTL -= min(aged[i].Header.TTL, elapsed)
+	}
+	return aged
+}
@@ -0,0 +1,81 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// testCacheResponse answers query with an A record and an OPT record
+func testCacheResponse(t *testing.T, query []byte) []byte {
+	t.Helper()
+	var msg dnsmessage.Message
+	if err := msg.Unpack(query); err != nil {
+		t.Fatal(err)
+	}
+	msg.Header.Response = true
+	msg.Answers = []dnsmessage.Resource{{
+		Header: dnsmessage.ResourceHeader{
+			Name:  msg.Questions[0].Name,
+			Type:  dnsmessage.TypeA,
+			Class: dnsmessage.ClassINET,
+			TTL:   300,
+		},
+		Body: &dnsmessage.AResource{A: [4]byte{192, 0, 2, 1}},
+	}}
+	var rh dnsmessage.ResourceHeader
+	if err := rh.SetEDNS0(1232, dnsmessage.RCodeSuccess, false); err != nil {
+		t.Fatal(err)
+	}
+	msg.Additionals = []dnsmessage.Resource{{Header: rh, Body: &dnsmessage.OPTResource{}}}
+	response, err := msg.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return response
+}
+
+func TestDNSCacheKeyedOnDNSSECBits(t *testing.T) {
+	c := newDNSCache(10)
+	cdQuery := testDNSQuery(1, "example.com.", testQueryOpts{qtype: dnsmessage.TypeA, edns: true, cd: true})
+	c.put(cdQuery, testCacheResponse(t, cdQuery))
+
+	if _, ok := c.get(cdQuery); !ok {
+		t.Fatal("CD=1 query missed its own cached response")
+	}
+	if _, ok := c.get(testDNSQuery(1, "example.com.", testQueryOpts{qtype: dnsmessage.TypeA, edns: true})); ok {
+		t.Error("CD=1 response served to a CD=0 query")
+	}
+	if _, ok := c.get(testDNSQuery(1, "example.com.", testQueryOpts{qtype: dnsmessage.TypeA, edns: true, do: true, cd: true})); ok {
+		t.Error("DO=0 response served to a DO=1 query")
+	}
+	if _, ok := c.get(testDNSQuery(1, "example.com.", testQueryOpts{qtype: dnsmessage.TypeA, cd: true})); ok {
+		t.Error("EDNS response served to a query without EDNS")
+	}
+}
+
+func TestDNSCacheStripsOPTWithoutEDNS(t *testing.T) {
+	c := newDNSCache(10)
+	query := testDNSQuery(1, "example.com.", testQueryOpts{qtype: dnsmessage.TypeA})
+	c.put(query, testCacheResponse(t, query))
+
+	response, ok := c.get(query)
+	if !ok {
+		t.Fatal("cache miss")
+	}
+	var msg dnsmessage.Message
+	if err := msg.Unpack(response); err != nil {
+		t.Fatal(err)
+	}
+	for _, rr := range msg.Additionals {
+		if rr.Header.Type == dnsmessage.TypeOPT {
+			t.Error("OPT record sent to a client without EDNS")
+		}
+	}
+	if len(msg.Answers) != 1 {
+		t.Errorf("got %d answers, want 1", len(msg.Answers))
+	}
+}
@@ -0,0 +1,317 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// dnsBufferSize is the largest DNS message forwarded over UDP
+	dnsBufferSize = 4096
+
+	// dnsHeaderSize is the size of the fixed DNS message header
+	dnsHeaderSize = 12
+
+	// dnsUpstreamSockets is the number of UDP sockets shared by all queries
+	// to the upstream
+	dnsUpstreamSockets = 4
+
+	// dnsMaxWorkers limits the number of queries handled at the same time.
+	// Once reached the read loops wait for a query to finish.
+	dnsMaxWorkers = 256
+
+	// dnsQueryTimeout is how long to wait for the upstream to answer
+	dnsQueryTimeout = 5 * time.Second
+)
+
+// errDNSTimeout is returned by exchange when the upstream did not answer
+var errDNSTimeout = errors.New("upstream DNS query timed out")
+
+// dnsBufferPool holds *[]byte buffers of dnsBufferSize bytes. Every query
+// and response gets its own buffer so concurrent queries never share memory.
+var dnsBufferPool = sync.Pool{
+	New: func() any {
+		b := make([]byte, dnsBufferSize)
+		return &b
+	},
+}
+
+// getDNSBuffer returns a buffer of dnsBufferSize bytes from the pool
+func getDNSBuffer() *[]byte {
+	return dnsBufferPool.Get().(*[]byte)
+}
+
+// putDNSBuffer returns a buffer to the pool
+func putDNSBuffer(b *[]byte) {
+	*b = (*b)[:cap(*b)]
+	dnsBufferPool.Put(b)
+}
+
+// dnsForwarder forwards DNS queries to the upstream over a fixed set of UDP
+// sockets. Queries get a transaction ID that is unique on their socket so
+// responses can be matched back to the waiting query.
+type dnsForwarder struct {
+	upstreamAddr string
+	cache        *dnsCache       // nil when caching is disabled
+	queryLog     *dnsQueryLogger // nil when query logging is disabled
+	sockets      []*dnsUpstreamSocket
+	next         atomic.Uint32 // round robin socket index
+	workers      chan struct{} // one entry per running query
+}
+
+// dnsUpstreamSocket is a UDP socket to the upstream with the queries that
+// are waiting for a response on it
+type dnsUpstreamSocket struct {
+	conn *net.UDPConn
+
+	mu      sync.Mutex
+	pending map[uint16]chan *[]byte
+}
+
+// newDNSForwarder opens the UDP sockets to the upstream at upstreamAddr.
+// Responses are cached when cache is not nil and queries are logged when
+// queryLog is not nil.
+func newDNSForwarder(upstreamAddr string, cache *dnsCache, queryLog *dnsQueryLogger) (*dnsForwarder, error) {
+	raddr, err := net.ResolveUDPAddr("udp", upstreamAddr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid upstream DNS address: %w", err)
+	}
+
+	f := &dnsForwarder{
+		upstreamAddr: upstreamAddr,
+		cache:        cache,
+		queryLog:     queryLog,
+		workers:      make(chan struct{}, dnsMaxWorkers),
+	}
+	for range dnsUpstreamSockets {
+		conn, err := net.DialUDP("udp", nil, raddr)
+		if err != nil {
+			f.close()
+			return nil, fmt.Errorf("failed to open upstream DNS socket: %w", err)
+		}
+		s := &dnsUpstreamSocket{conn: conn, pending: make(map[uint16]chan *[]byte)}
+		f.sockets = append(f.sockets, s)
+		go s.readLoop()
+	}
+	return f, nil
+}
+
+// close closes the upstream sockets, waiting queries time out
+func (f *dnsForwarder) close() {
+	for _, s := range f.sockets {
+		s.conn.Close()
+	}
+}
+
+// serveUDP reads queries from conn and answers them until ctx is cancelled.
+// Each query is copied into its own buffer and handled by a worker, at most
+// dnsMaxWorkers at a time across all of f's listeners.
+func (f *dnsForwarder) serveUDP(ctx context.Context, conn net.PacketConn) {
+	// closing conn unblocks ReadFrom on shutdown
+	stop := context.AfterFunc(ctx, func() {
+		conn.Close()
+	})
+	defer stop()
+	defer conn.Close()
+
+	for {
+		query := getDNSBuffer()
+		n, clientAddr, err := conn.ReadFrom(*query)
+		start := time.Now()
+		if err != nil {
+			putDNSBuffer(query)
+			if ctx.Err() != nil || errors.Is(err, net.ErrClosed) {
+				return
+			}
+			slog.Error("DNS read error", "error", err)
+			continue
+		}
+
+		// drop queries until the upstream is ready, clients will retry
+		if !upstreamReady.Ready() {
+			slog.Debug("DNS query dropped, upstream not ready", "client", clientAddr)
+			putDNSBuffer(query)
+			continue
+		}
+		if n < dnsHeaderSize {
+			slog.Debug("DNS query dropped, too short", "client", clientAddr, "size", n)
+			putDNSBuffer(query)
+			continue
+		}
+		*query = (*query)[:n]
+
+		select {
+		case f.workers <- struct{}{}:
+		case <-ctx.Done():
+			putDNSBuffer(query)
+			return
+		}
+		go func() {
+			defer func() { <-f.workers }()
+			f.queryLog.log(f.handleUDPQuery(ctx, conn, clientAddr, query, start))
+		}()
+	}
+}
+
+// handleUDPQuery answers query from the cache or forwards it to the
+// upstream, and sends the response back to the client. The query buffer is
+// returned to the pool. It returns the record to log, nil when query
+// logging is disabled or ctx was cancelled.
+func (f *dnsForwarder) handleUDPQuery(ctx context.Context, conn net.PacketConn, clientAddr net.Addr, query *[]byte, start time.Time) *dnsQueryRecord {
+	defer putDNSBuffer(query)
+
+	rec := dnsQueryRecord{
+		client:    addrOf(clientAddr),
+		transport: "udp",
+		start:     start,
+	}
+
+	if response, ok := f.cache.get(*query); ok {
+		f.reply(conn, clientAddr, response)
+		rec.cached = true
+		return f.queryLog.finish(rec, *query, response)
+	}
+
+	response, err := f.exchange(ctx, *query)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil
+		}
+		slog.Error("upstream DNS query failed", "error", err, "upstream", f.upstreamAddr)
+		upstreamErrors.Add(upstreamLabels{Upstream: f.upstreamAddr}, 1)
+		rec.err = err
+		return f.queryLog.finish(rec, *query, nil)
+	}
+	defer putDNSBuffer(response)
+
+	f.cache.put(*query, *response)
+	f.reply(conn, clientAddr, *response)
+	return f.queryLog.finish(rec, *query, *response)
+}
+
+// reply sends a response to the client
+func (f *dnsForwarder) reply(conn net.PacketConn, clientAddr net.Addr, response []byte) {
+	countDNSResponse(response)
+	if _, err := conn.WriteTo(response, clientAddr); err != nil {
+		slog.Error("failed to write response to client", "error", err)
+	}
+}
+
+// exchange sends query to the upstream and waits for the matching response.
+// The transaction ID of query is replaced while it is in flight and the
+// original ID is put back into the response. The caller must return the
+// response to the pool with putDNSBuffer.
+func (f *dnsForwarder) exchange(ctx context.Context, query []byte) (*[]byte, error) {
+	if len(query) < dnsHeaderSize {
+		return nil, fmt.Errorf("DNS query too short: %d bytes", len(query))
+	}
+	s := f.sockets[f.next.Add(1)%uint32(len(f.sockets))]
+
+	origID := binary.BigEndian.Uint16(query)
+	id, ch := s.register()
+	defer s.unregister(id, ch)
+
+	binary.BigEndian.PutUint16(query, id)
+	_, err := s.conn.Write(query)
+	binary.BigEndian.PutUint16(query, origID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to write to upstream DNS: %w", err)
+	}
+
+	timer := time.NewTimer(dnsQueryTimeout)
+	defer timer.Stop()
+
+	select {
+	case response := <-ch:
+		binary.BigEndian.PutUint16(*response, origID)
+		return response, nil
+	case <-timer.C:
+		return nil, errDNSTimeout
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// register reserves a transaction ID that is not in use on s and returns
+// the channel its response is delivered on
+func (s *dnsUpstreamSocket) register() (uint16, chan *[]byte) {
+	ch := make(chan *[]byte, 1)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for {
+		id := uint16(rand.N(1 << 16))
+		if _, ok := s.pending[id]; !ok {
+			s.pending[id] = ch
+			return id, ch
+		}
+	}
+}
+
+// unregister releases the transaction ID reserved with ch, unless the read
+// loop already released it and another query now owns it. A response that
+// arrived but was never received is returned to the pool.
+func (s *dnsUpstreamSocket) unregister(id uint16, ch chan *[]byte) {
+	s.mu.Lock()
+	if s.pending[id] == ch {
+		delete(s.pending, id)
+	}
+	s.mu.Unlock()
+
+	select {
+	case response := <-ch:
+		putDNSBuffer(response)
+	default:
+	}
+}
+
+// readLoop delivers responses from the upstream to the waiting queries
+// until the socket is closed. Responses nobody is waiting for, such as late
+// answers to timed out queries, are dropped.
+func (s *dnsUpstreamSocket) readLoop() {
+	for {
+		response := getDNSBuffer()
+		n, err := s.conn.Read(*response)
+		if err != nil {
+			putDNSBuffer(response)
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			// e.g. connection refused while the upstream is restarting
+			slog.Debug("upstream DNS read error", "error", err)
+			continue
+		}
+		if n < dnsHeaderSize {
+			putDNSBuffer(response)
+			continue
+		}
+		*response = (*response)[:n]
+
+		id := binary.BigEndian.Uint16(*response)
+		s.mu.Lock()
+		ch, ok := s.pending[id]
+		if ok {
+			delete(s.pending, id)
+		}
+		s.mu.Unlock()
+
+		if !ok {
+			slog.Debug("dropped unexpected upstream DNS response", "id", id)
+			putDNSBuffer(response)
+			continue
+		}
+		ch <- response
+	}
+}
@@ -0,0 +1,205 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// startTestDNSUpstream starts a loopback UDP DNS server that answers every
+// query with its own ID and question after a random delay, so responses
+// arrive out of order
+func startTestDNSUpstream(t *testing.T) string {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	go func() {
+		for {
+			buf := make([]byte, dnsBufferSize)
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			go func() {
+				var msg dnsmessage.Message
+				if err := msg.Unpack(buf[:n]); err != nil {
+					return
+				}
+				time.Sleep(time.Duration(rand.N(20)) * time.Millisecond)
+				msg.Header.Response = true
+				msg.Answers = []dnsmessage.Resource{{
+					Header: dnsmessage.ResourceHeader{
+						Name:  msg.Questions[0].Name,
+						Type:  dnsmessage.TypeTXT,
+						Class: dnsmessage.ClassINET,
+						TTL:   60,
+					},
+					Body: &dnsmessage.TXTResource{TXT: []string{msg.Questions[0].Name.String()}},
+				}}
+				response, err := msg.Pack()
+				if err != nil {
+					return
+				}
+				conn.WriteTo(response, addr)
+			}()
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+// testQueryOpts are the optional parts of a test query
+type testQueryOpts struct {
+	qtype dnsmessage.Type // TXT when zero
+	edns  bool            // add an OPT record
+	do    bool            // DNSSEC OK, needs edns
+	cd    bool            // checking disabled
+}
+
+// testDNSQuery builds a query for name with transaction ID id
+func testDNSQuery(id uint16, name string, opts testQueryOpts) []byte {
+	qtype := opts.qtype
+	if qtype == 0 {
+		qtype = dnsmessage.TypeTXT
+	}
+	msg := dnsmessage.Message{
+		Header: dnsmessage.Header{ID: id, RecursionDesired: true, CheckingDisabled: opts.cd},
+		Questions: []dnsmessage.Question{{
+			Name:  dnsmessage.MustNewName(name),
+			Type:  qtype,
+			Class: dnsmessage.ClassINET,
+		}},
+	}
+	if opts.edns {
+		var rh dnsmessage.ResourceHeader
+		if err := rh.SetEDNS0(1232, dnsmessage.RCodeSuccess, opts.do); err != nil {
+			panic(err)
+		}
+		msg.Additionals = []dnsmessage.Resource{{Header: rh, Body: &dnsmessage.OPTResource{}}}
+	}
+	query, err := msg.Pack()
+	if err != nil {
+		panic(err)
+	}
+	return query
+}
+
+// checkDNSResponse fails unless response answers the query with id and name
+func checkDNSResponse(response []byte, id uint16, name string) error {
+	var msg dnsmessage.Message
+	if err := msg.Unpack(response); err != nil {
+		return fmt.Errorf("invalid response: %w", err)
+	}
+	if msg.Header.ID != id {
+		return fmt.Errorf("got ID %d, want %d", msg.Header.ID, id)
+	}
+	if len(msg.Questions) != 1 || msg.Questions[0].Name.String() != name {
+		return fmt.Errorf("got questions %v, want %s", msg.Questions, name)
+	}
+	if len(msg.Answers) != 1 {
+		return fmt.Errorf("got %d answers, want 1", len(msg.Answers))
+	}
+	if txt, ok := msg.Answers[0].Body.(*dnsmessage.TXTResource); !ok || txt.TXT[0] != name {
+		return fmt.Errorf("got answer %v, want %s", msg.Answers[0].Body, name)
+	}
+	return nil
+}
+
+// newTestDNSForwarder creates a forwarder to a test upstream
+func newTestDNSForwarder(t *testing.T) *dnsForwarder {
+	t.Helper()
+	rd, err := newReadiness("", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := upstreamReady
+	upstreamReady = rd
+	t.Cleanup(func() { upstreamReady = old })
+
+	f, err := newDNSForwarder(startTestDNSUpstream(t), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(f.close)
+	return f
+}
+
+func TestDNSForwarderExchangeConcurrent(t *testing.T) {
+	f := newTestDNSForwarder(t)
+
+	var wg sync.WaitGroup
+	for i := range 200 {
+		wg.Go(func() {
+			// every query uses the same ID, the forwarder must still keep
+			// them apart upstream
+			name := fmt.Sprintf("q%d.example.", i)
+			response, err := f.exchange(t.Context(), testDNSQuery(1234, name, testQueryOpts{}))
+			if err != nil {
+				t.Errorf("%s: %v", name, err)
+				return
+			}
+			defer putDNSBuffer(response)
+			if err := checkDNSResponse(*response, 1234, name); err != nil {
+				t.Errorf("%s: %v", name, err)
+			}
+		})
+	}
+	wg.Wait()
+}
+
+func TestDNSForwarderServeUDPConcurrent(t *testing.T) {
+	f := newTestDNSForwarder(t)
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(t.Context())
+	defer cancel()
+	go f.serveUDP(ctx, conn)
+
+	const clients, queries = 50, 20
+	var wg sync.WaitGroup
+	for c := range clients {
+		wg.Go(func() {
+			client, err := net.Dial("udp", conn.LocalAddr().String())
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer client.Close()
+
+			for q := range queries {
+				id := uint16(c*queries + q)
+				name := fmt.Sprintf("c%d-q%d.example.", c, q)
+				if _, err := client.Write(testDNSQuery(id, name, testQueryOpts{})); err != nil {
+					t.Error(err)
+					return
+				}
+				client.SetReadDeadline(time.Now().Add(dnsQueryTimeout))
+				buf := make([]byte, dnsBufferSize)
+				n, err := client.Read(buf)
+				if err != nil {
+					t.Errorf("%s: %v", name, err)
+					return
+				}
+				if err := checkDNSResponse(buf[:n], id, name); err != nil {
+					t.Errorf("%s: %v", name, err)
+				}
+			}
+		})
+	}
+	wg.Wait()
+}
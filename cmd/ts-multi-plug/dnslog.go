@@ -0,0 +1,232 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+	"tailscale.com/client/local"
+	"tailscale.com/util/lru"
+	"tailscale.com/util/singleflight"
+)
+
+const (
+	// dnsIdentityTTL is how long the WhoIs identity of a client address is
+	// reused before it is looked up again
+	dnsIdentityTTL = time.Minute
+
+	// dnsIdentityCacheSize is the number of client identities kept
+	dnsIdentityCacheSize = 1024
+
+	// dnsWhoisTimeout bounds a single WhoIs lookup
+	dnsWhoisTimeout = 2 * time.Second
+
+	// dnsQueryLogQueue is the number of finished queries waiting to be
+	// logged. Once full further queries are dropped from the log.
+	dnsQueryLogQueue = 1024
+
+	// dnsQueryLogWriters is the number of goroutines writing the query log,
+	// each may wait for a WhoIs lookup
+	dnsQueryLogWriters = 4
+)
+
+// dnsQueryLogDropped counts queries left out of the log because the queue
+// was full
+var dnsQueryLogDropped = newInt("counter_tsplug_dns_query_log_dropped")
+
+// dnsIdentity is the tailnet identity of a DNS client
+type dnsIdentity struct {
+	login   string
+	node    string
+	expires time.Time
+}
+
+// dnsQueryLogger logs every DNS query with the tailnet identity of the
+// client, at debug level and to the -dns-query-log file. A nil
+// *dnsQueryLogger logs nothing. Records are queued and written by a fixed
+// set of goroutines so slow WhoIs lookups never hold up queries.
+type dnsQueryLogger struct {
+	lc      *local.Client
+	records chan *dnsQueryRecord
+
+	mu         sync.Mutex
+	identities *lru.Cache[netip.Addr, dnsIdentity]
+
+	// lookups shares one WhoIs call between queries from the same address
+	lookups singleflight.Group[netip.Addr, dnsIdentity]
+}
+
+// newDNSQueryLogger returns a logger that looks up clients with lc, or nil
+// when neither debug logging nor -dns-query-log is enabled. It logs until
+// ctx is cancelled.
+func newDNSQueryLogger(ctx context.Context, lc *local.Client) *dnsQueryLogger {
+	if dnsQueryLog == nil && !slog.Default().Enabled(ctx, slog.LevelDebug) {
+		return nil
+	}
+	l := &dnsQueryLogger{
+		lc:         lc,
+		records:    make(chan *dnsQueryRecord, dnsQueryLogQueue),
+		identities: &lru.Cache[netip.Addr, dnsIdentity]{MaxEntries: dnsIdentityCacheSize},
+	}
+	for range dnsQueryLogWriters {
+		go l.run(ctx)
+	}
+	return l
+}
+
+// run writes queued records until ctx is cancelled
+func (l *dnsQueryLogger) run(ctx context.Context) {
+	for {
+		select {
+		case rec := <-l.records:
+			l.write(ctx, rec)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// log queues rec to be written, or drops it when the queue is full
+func (l *dnsQueryLogger) log(rec *dnsQueryRecord) {
+	if l == nil || rec == nil {
+		return
+	}
+	select {
+	case l.records <- rec:
+	default:
+		dnsQueryLogDropped.Add(1)
+	}
+}
+
+// dnsQueryRecord is a DNS query for the query log
+type dnsQueryRecord struct {
+	client    netip.Addr
+	transport string    // udp or tcp
+	start     time.Time // when the query was read
+	cached    bool
+	err       error // the upstream didn't answer
+
+	// set by finish
+	qname   string
+	qtype   string
+	rcode   string
+	latency time.Duration
+}
+
+// finish completes rec with the question of query, the response code of
+// response and the latency so far. It returns nil when l is nil. The
+// record doesn't refer to query or response, so their buffers can be
+// reused before it is logged.
+func (l *dnsQueryLogger) finish(rec dnsQueryRecord, query, response []byte) *dnsQueryRecord {
+	if l == nil {
+		return nil
+	}
+	rec.latency = time.Since(rec.start)
+
+	var p dnsmessage.Parser
+	if _, err := p.Start(query); err == nil {
+		if q, err := p.Question(); err == nil {
+			rec.qname = q.Name.String()
+			rec.qtype = strings.TrimPrefix(q.Type.String(), "Type")
+		}
+	}
+	if response != nil {
+		var p dnsmessage.Parser
+		if h, err := p.Start(response); err == nil {
+			rec.rcode = rcodeName(h.RCode)
+		}
+	}
+	return &rec
+}
+
+// write writes rec to the debug log and the query log with the identity
+// of the client
+func (l *dnsQueryLogger) write(ctx context.Context, rec *dnsQueryRecord) {
+	id := l.identity(ctx, rec.client)
+
+	attrs := []slog.Attr{
+		slog.String("client", rec.client.String()),
+		slog.String("transport", rec.transport),
+	}
+	if rec.qname != "" {
+		attrs = append(attrs,
+			slog.String("qname", rec.qname),
+			slog.String("qtype", rec.qtype),
+		)
+	}
+	if rec.rcode != "" {
+		attrs = append(attrs, slog.String("rcode", rec.rcode))
+	}
+	attrs = append(attrs,
+		slog.Float64("latency_ms", float64(rec.latency.Microseconds())/1000),
+		slog.Bool("cached", rec.cached),
+		slog.String("login", id.login),
+		slog.String("node", id.node),
+	)
+	if rec.err != nil {
+		attrs = append(attrs, slog.String("error", rec.err.Error()))
+	}
+
+	slog.LogAttrs(ctx, slog.LevelDebug, "DNS query", attrs...)
+	if dnsQueryLog != nil {
+		dnsQueryLog.LogAttrs(ctx, slog.LevelInfo, "dns", attrs...)
+	}
+}
+
+// identity returns the login and node name of addr. Lookups, failed ones
+// included, are cached for dnsIdentityTTL so busy clients don't cost a
+// WhoIs call per query, and concurrent queries from an address that isn't
+// cached wait for a single WhoIs call.
+func (l *dnsQueryLogger) identity(ctx context.Context, addr netip.Addr) dnsIdentity {
+	l.mu.Lock()
+	id, ok := l.identities.GetOk(addr)
+	l.mu.Unlock()
+	if ok && time.Now().Before(id.expires) {
+		return id
+	}
+
+	id, _, _ = l.lookups.Do(addr, func() (dnsIdentity, error) {
+		return l.lookup(ctx, addr), nil
+	})
+	return id
+}
+
+// lookup asks WhoIs for the identity of addr and caches the result
+func (l *dnsQueryLogger) lookup(ctx context.Context, addr netip.Addr) dnsIdentity {
+	id := dnsIdentity{expires: time.Now().Add(dnsIdentityTTL)}
+	ctx, cancel := context.WithTimeout(ctx, dnsWhoisTimeout)
+	defer cancel()
+	if who, err := l.lc.WhoIs(ctx, addr.String()); err != nil {
+		slog.Debug("DNS client whois lookup failed", "error", err, "client", addr)
+		whoisFailures.Add(1)
+	} else {
+		if who.UserProfile != nil && who.UserProfile.LoginName != "tagged-devices" {
+			id.login = who.UserProfile.LoginName
+		}
+		if who.Node != nil {
+			id.node = strings.TrimSuffix(who.Node.Name, ".")
+		}
+	}
+
+	l.mu.Lock()
+	l.identities.Set(addr, id)
+	l.mu.Unlock()
+	return id
+}
+
+// addrOf returns the IP address of a client net.Addr
+func addrOf(a net.Addr) netip.Addr {
+	ap, err := netip.ParseAddrPort(a.String())
+	if err != nil {
+		return netip.Addr{}
+	}
+	return ap.Addr().Unmap()
+}
@@ -0,0 +1,22 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import "testing"
+
+func TestDNSQueryLogDropsWhenFull(t *testing.T) {
+	// no writers, so the queue fills up
+	l := &dnsQueryLogger{records: make(chan *dnsQueryRecord, 2)}
+	dropped := dnsQueryLogDropped.Value()
+
+	for range 5 {
+		l.log(&dnsQueryRecord{transport: "udp"})
+	}
+	if got := len(l.records); got != 2 {
+		t.Errorf("queued %d records, want 2", got)
+	}
+	if got := dnsQueryLogDropped.Value() - dropped; got != 3 {
+		t.Errorf("dropped %d records, want 3", got)
+	}
+}
@@ -0,0 +1,106 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/netip"
+	"path"
+	"slices"
+	"strings"
+
+	"tailscale.com/ipn"
+)
+
+// funnelSrcKey is the context key holding the public client address of a
+// connection that arrived over Funnel
+type funnelSrcKey struct{}
+
+// funnelConnContext is used as http.Server.ConnContext to mark connections
+// that arrived over Funnel. Tailnet connections are left unmarked.
+func funnelConnContext(ctx context.Context, c net.Conn) context.Context {
+	if tc, ok := c.(*tls.Conn); ok {
+		c = tc.NetConn()
+	}
+	if fc, ok := c.(*ipn.FunnelConn); ok {
+		return context.WithValue(ctx, funnelSrcKey{}, fc.Src)
+	}
+	return ctx
+}
+
+// funnelSource returns the public internet address of the client when the
+// request arrived over Funnel
+func funnelSource(ctx context.Context) (netip.AddrPort, bool) {
+	src, ok := ctx.Value(funnelSrcKey{}).(netip.AddrPort)
+	return src, ok
+}
+
+// funnelPathAllowed reports whether a Funnel request to p may reach the
+// upstream. Without any -funnel-allow-path every path is allowed. Paths that
+// aren't clean, such as /public/../admin, are rejected since the upstream
+// may resolve them to a path outside the allowed prefixes.
+func funnelPathAllowed(p string) bool {
+	if len(flagFunnelPaths) == 0 {
+		return true
+	}
+	cleaned := path.Clean(p)
+	if strings.HasSuffix(p, "/") && cleaned != "/" {
+		cleaned += "/"
+	}
+	if cleaned != p {
+		return false
+	}
+	for _, prefix := range flagFunnelPaths {
+		if pathHasPrefix(cleaned, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// validateFunnelPaths checks that -funnel-allow-path values are paths
+func validateFunnelPaths(paths []string) error {
+	for _, p := range paths {
+		if !strings.HasPrefix(p, "/") {
+			return fmt.Errorf("funnel path must start with /: %s", p)
+		}
+	}
+	return nil
+}
+
+// funnelPorts are the only ports Funnel accepts traffic on
+var funnelPorts = []int{443, 8443, 10000}
+
+// validateFunnelListeners checks that every listener exposed over Funnel
+// uses a port Funnel supports
+func validateFunnelListeners() error {
+	if *flagFunnelOnly && !flagFunnel.IsSet() && !*flagPublic {
+		return fmt.Errorf("-funnel-only requires -funnel-port or -public")
+	}
+	for _, m := range flagFunnel.Maps {
+		if !slices.Contains(funnelPorts, m.In) {
+			return fmt.Errorf("-funnel-port %s: funnel only supports ports 443, 8443 and 10000", m)
+		}
+	}
+	if *flagPublic {
+		for _, h := range flagHttps.Maps {
+			if !slices.Contains(funnelPorts, h.In) {
+				return fmt.Errorf("-https-port %s: -public requires port 443, 8443 or 10000", h)
+			}
+		}
+	}
+	return nil
+}
+
+// funnelRoutes returns the routes for -funnel-port listeners. Without any
+// -funnel-route they share the -route list with the tailnet listeners.
+func funnelRoutes() []Route {
+	if flagFunnelRoutes.IsSet() {
+		return flagFunnelRoutes.Routes
+	}
+	return flagRoutes.Routes
+}
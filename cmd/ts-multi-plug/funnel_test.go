@@ -0,0 +1,43 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestFunnelPathAllowed(t *testing.T) {
+	old := flagFunnelPaths
+	flagFunnelPaths = StringListFlag{"/public", "/webhooks/"}
+	t.Cleanup(func() { flagFunnelPaths = old })
+
+	tests := []struct {
+		target string
+		want   bool
+	}{
+		{"/public", true},
+		{"/public/", true},
+		{"/public/index.html", true},
+		{"/webhooks/github", true},
+		{"/admin", false},
+		{"/publicity", false},
+		{"/public/../admin", false},
+		{"/public/%2e%2e/admin", false},
+		{"/public/%2E%2E/admin", false},
+		{"/public/./index.html", false},
+		{"/public//index.html", false},
+		{"/public%2f..%2fadmin", false},
+	}
+	for _, tt := range tests {
+		// parse like the server does, so percent-encoded dots are decoded
+		r, err := http.NewRequest("GET", "https://example.com"+tt.target, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := funnelPathAllowed(r.URL.Path); got != tt.want {
+			t.Errorf("funnelPathAllowed(%q) = %v, want %v (path %q)", tt.target, got, tt.want, r.URL.Path)
+		}
+	}
+}
@@ -0,0 +1,316 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+	"tailscale.com/metrics"
+	"tailscale.com/tsnet"
+	"tailscale.com/tsweb/varz"
+)
+
+// metricsVars holds the ts-plug metrics. They are kept out of the global
+// expvar map so /metrics doesn't include the tsnet internals.
+var metricsVars = new(expvar.Map).Init()
+
+// startTime is used for the uptime gauge
+var startTime = time.Now()
+
+type requestLabels struct {
+	Listener string
+	Code     string
+}
+
+type listenerLabels struct {
+	Listener string
+}
+
+type upstreamLabels struct {
+	Upstream string
+}
+
+type dnsLabels struct {
+	Rcode string
+}
+
+var (
+	httpRequests   = newLabelMap[requestLabels]("counter_tsplug_http_requests", "counter", "HTTP requests by listener and status code")
+	httpDuration   = newHistogramMap[requestLabels]("histogram_tsplug_http_request_duration_seconds", "HTTP request latency by listener and status code", durationBuckets)
+	tcpConnections = newLabelMap[listenerLabels]("counter_tsplug_tcp_connections", "counter", "TCP connections by listener")
+	upstreamErrors = newLabelMap[upstreamLabels]("counter_tsplug_upstream_errors", "counter", "Failed connections and requests to the upstream")
+	dnsQueries     = newLabelMap[dnsLabels]("counter_tsplug_dns_queries", "counter", "DNS queries by response code")
+	whoisFailures  = newInt("counter_tsplug_whois_failures")
+	childRestarts  = newInt("counter_tsplug_child_restarts")
+)
+
+// durationBuckets are the request latency histogram buckets in seconds
+var durationBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+func init() {
+	metricsVars.Set("gauge_tsplug_uptime_seconds", expvar.Func(func() any {
+		return int64(time.Since(startTime).Seconds())
+	}))
+	metricsVars.Set("gauge_tsplug_upstream_ready", expvar.Func(func() any {
+		if upstreamReady != nil && upstreamReady.Ready() {
+			return int64(1)
+		}
+		return int64(0)
+	}))
+}
+
+// newLabelMap creates a counter or gauge with labels and adds it to metricsVars
+func newLabelMap[T comparable](name, promType, help string) *metrics.MultiLabelMap[T] {
+	m := &metrics.MultiLabelMap[T]{Type: promType, Help: help}
+	metricsVars.Set(name, m)
+	return m
+}
+
+// newInt creates a counter without labels and adds it to metricsVars
+func newInt(name string) *expvar.Int {
+	v := new(expvar.Int)
+	metricsVars.Set(name, v)
+	return v
+}
+
+// publishSupervisorMetrics adds the gauges that report on the command run by s
+func publishSupervisorMetrics(s *supervisor) {
+	metricsVars.Set("gauge_tsplug_child_uptime_seconds", expvar.Func(func() any {
+		return int64(s.uptime().Seconds())
+	}))
+}
+
+// histogramMap is a histogram with labels, the histogram counterpart of
+// metrics.MultiLabelMap
+type histogramMap[T comparable] struct {
+	help    string
+	buckets []float64
+
+	mu     sync.Mutex
+	series map[T]*histogramSeries
+}
+
+type histogramSeries struct {
+	counts []int64 // cumulative, one per bucket
+	count  int64
+	sum    float64
+}
+
+// newHistogramMap creates a histogram with labels and adds it to metricsVars
+func newHistogramMap[T comparable](name, help string, buckets []float64) *histogramMap[T] {
+	h := &histogramMap[T]{
+		help:    help,
+		buckets: buckets,
+		series:  make(map[T]*histogramSeries),
+	}
+	metricsVars.Set(name, h)
+	return h
+}
+
+// Observe records v in the series for key
+func (h *histogramMap[T]) Observe(key T, v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	s, ok := h.series[key]
+	if !ok {
+		s = &histogramSeries{counts: make([]int64, len(h.buckets))}
+		h.series[key] = s
+	}
+	for i, b := range h.buckets {
+		if v <= b {
+			s.counts[i]++
+		}
+	}
+	s.count++
+	s.sum += v
+}
+
+// String implements expvar.Var
+func (h *histogramMap[T]) String() string {
+	return `"histogramMap"`
+}
+
+// WritePrometheus writes h to w in Prometheus exposition format
+func (h *histogramMap[T]) WritePrometheus(w io.Writer, name string) {
+	fmt.Fprintf(w, "# TYPE %s histogram\n", name)
+	fmt.Fprintf(w, "# HELP %s %s\n", name, h.help)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	type entry struct {
+		labels string
+		*histogramSeries
+	}
+	entries := make([]entry, 0, len(h.series))
+	for k, s := range h.series {
+		entries = append(entries, entry{metrics.LabelString(k), s})
+	}
+	slices.SortFunc(entries, func(a, b entry) int {
+		return cmp.Compare(a.labels, b.labels)
+	})
+
+	for _, e := range entries {
+		labels := strings.TrimSuffix(e.labels, "}")
+		for i, b := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket%s,le=%q} %d\n", name, labels, strconv.FormatFloat(b, 'g', -1, 64), e.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s,le=\"+Inf\"} %d\n", name, labels, e.count)
+		fmt.Fprintf(w, "%s_sum%s %v\n", name, e.labels, e.sum)
+		fmt.Fprintf(w, "%s_count%s %d\n", name, e.labels, e.count)
+	}
+}
+
+// instrumentHandler counts the requests served by next and records their
+// latency under the listener label. With -access-log every request is also
+// written to the access log.
+func instrumentHandler(listener string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, code: http.StatusOK}
+
+		var info *requestInfo
+		if accessLog != nil {
+			info = &requestInfo{remote: r.RemoteAddr}
+			r = withRequestInfo(r, info)
+		}
+
+		next.ServeHTTP(rec, r)
+		duration := time.Since(start)
+
+		labels := requestLabels{Listener: listener, Code: strconv.Itoa(rec.code)}
+		httpRequests.Add(labels, 1)
+		httpDuration.Observe(labels, duration.Seconds())
+
+		if info != nil {
+			logAccess(r, listener, rec, duration, info)
+		}
+	})
+}
+
+// statusRecorder remembers the status code and body size written to a
+// ResponseWriter
+type statusRecorder struct {
+	http.ResponseWriter
+	code        int
+	bytes       int64
+	wroteHeader bool
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	// informational responses are followed by the real status, except for
+	// 101 Switching Protocols
+	if !r.wroteHeader && (code >= 200 || code == http.StatusSwitchingProtocols) {
+		r.code = code
+		r.wroteHeader = true
+	}
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	r.wroteHeader = true
+	n, err := r.ResponseWriter.Write(b)
+	r.bytes += int64(n)
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach the Flusher and Hijacker of
+// the underlying ResponseWriter, websockets rely on it
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// countDNSResponse counts a DNS query by the response code in response
+func countDNSResponse(response []byte) {
+	var p dnsmessage.Parser
+	h, err := p.Start(response)
+	if err != nil {
+		dnsQueries.Add(dnsLabels{Rcode: "invalid"}, 1)
+		return
+	}
+	dnsQueries.Add(dnsLabels{Rcode: rcodeName(h.RCode)}, 1)
+}
+
+// rcodeName returns the conventional name of a DNS response code
+func rcodeName(rc dnsmessage.RCode) string {
+	switch rc {
+	case dnsmessage.RCodeSuccess:
+		return "NOERROR"
+	case dnsmessage.RCodeFormatError:
+		return "FORMERR"
+	case dnsmessage.RCodeServerFailure:
+		return "SERVFAIL"
+	case dnsmessage.RCodeNameError:
+		return "NXDOMAIN"
+	case dnsmessage.RCodeNotImplemented:
+		return "NOTIMP"
+	case dnsmessage.RCodeRefused:
+		return "REFUSED"
+	default:
+		return strconv.Itoa(int(rc))
+	}
+}
+
+// validateMetricsAddr checks a -metrics-addr value
+func validateMetricsAddr(addr string) error {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return fmt.Errorf("invalid metrics address, expected :port or host:port: %w", err)
+	}
+	if p, err := strconv.Atoi(port); err != nil || p < 1 || p > 65535 {
+		return fmt.Errorf("invalid metrics port: %s", port)
+	}
+	return nil
+}
+
+// startMetricsListener serves Prometheus metrics at /metrics. An address
+// without a host such as ":9100" listens on the tailnet only, anything else
+// such as "127.0.0.1:9100" listens on the local machine.
+func startMetricsListener(ctx context.Context, ts *tsnet.Server, hostname, addr string) error {
+	host, port, _ := net.SplitHostPort(addr)
+
+	var listener net.Listener
+	var err error
+	if host == "" {
+		listener, err = ts.Listen("tcp", addr)
+		host = hostname
+	} else {
+		listener, err = net.Listen("tcp", addr)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to listen on metrics address %s: %w", addr, err)
+	}
+	defer listener.Close()
+
+	slog.Info(fmt.Sprintf("listening at (METRICS): http://%s/metrics", net.JoinHostPort(host, port)))
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /metrics", varz.ExpvarDoHandler(metricsVars.Do))
+	httpServer := &http.Server{Handler: mux}
+
+	go func() {
+		<-ctx.Done()
+		httpServer.Close()
+	}()
+
+	if err := httpServer.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return fmt.Errorf("metrics server error: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,184 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/tailcfg"
+)
+
+// groupsCapability is the app capability that lists the groups a caller
+// belongs to. Tailscale does not expose group membership to peers, so groups
+// are granted in the tailnet policy file, for example:
+//
+//	"grants": [{
+//		"src": ["group:eng"],
+//		"dst": ["tag:web"],
+//		"app": {"github.com/mostlygeek/ts-plug": [{"groups": ["group:eng"]}]}
+//	}]
+const groupsCapability tailcfg.PeerCapability = "github.com/mostlygeek/ts-plug"
+
+// groupsCapValue is the value of a groupsCapability grant
+type groupsCapValue struct {
+	Groups []string `json:"groups"`
+}
+
+// StringListFlag is a repeatable string flag. Each value may also be a comma
+// separated list.
+type StringListFlag []string
+
+func (s *StringListFlag) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *StringListFlag) Set(value string) error {
+	for v := range strings.SplitSeq(value, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			*s = append(*s, v)
+		}
+	}
+	return nil
+}
+
+// accessPolicy decides which tailnet callers may reach the upstream. Deny
+// rules are checked first. If there are any allow rules the caller must
+// match at least one of them.
+type accessPolicy struct {
+	AllowUsers  StringListFlag
+	AllowGroups StringListFlag
+	AllowTags   StringListFlag
+	DenyUsers   StringListFlag
+	DenyGroups  StringListFlag
+	DenyTags    StringListFlag
+}
+
+// enabled reports whether any rules are configured
+func (p *accessPolicy) enabled() bool {
+	return p.hasAllowRules() ||
+		len(p.DenyUsers) > 0 || len(p.DenyGroups) > 0 || len(p.DenyTags) > 0
+}
+
+func (p *accessPolicy) hasAllowRules() bool {
+	return len(p.AllowUsers) > 0 || len(p.AllowGroups) > 0 || len(p.AllowTags) > 0
+}
+
+// validate checks that rule values are well formed
+func (p *accessPolicy) validate() error {
+	for _, tag := range slices.Concat(p.AllowTags, p.DenyTags) {
+		if !strings.HasPrefix(tag, "tag:") {
+			return fmt.Errorf("invalid tag %q, tags must be in the format tag:name", tag)
+		}
+	}
+	for _, group := range slices.Concat(p.AllowGroups, p.DenyGroups) {
+		if !strings.HasPrefix(group, "group:") {
+			return fmt.Errorf("invalid group %q, groups must be in the format group:name", group)
+		}
+	}
+	return nil
+}
+
+// check returns whether the caller is allowed and, when it is not, the reason.
+// A nil who, from a failed WhoIs lookup, is always denied.
+func (p *accessPolicy) check(who *apitype.WhoIsResponse) (bool, string) {
+	if who == nil || who.Node == nil {
+		return false, "unknown caller"
+	}
+
+	var user string
+	if who.UserProfile != nil && !who.Node.IsTagged() {
+		user = who.UserProfile.LoginName
+	}
+	tags := who.Node.Tags
+	groups := callerGroups(who)
+
+	if u := matchUser(p.DenyUsers, user); u != "" {
+		return false, "denied user " + u
+	}
+	if g := matchAny(p.DenyGroups, groups); g != "" {
+		return false, "denied group " + g
+	}
+	if t := matchAny(p.DenyTags, tags); t != "" {
+		return false, "denied tag " + t
+	}
+
+	if !p.hasAllowRules() {
+		return true, ""
+	}
+	if matchUser(p.AllowUsers, user) != "" ||
+		matchAny(p.AllowGroups, groups) != "" ||
+		matchAny(p.AllowTags, tags) != "" {
+		return true, ""
+	}
+	return false, "no allow rule matched"
+}
+
+// callerGroups returns the groups granted to the caller via groupsCapability
+func callerGroups(who *apitype.WhoIsResponse) []string {
+	values, err := tailcfg.UnmarshalCapJSON[groupsCapValue](who.CapMap, groupsCapability)
+	if err != nil {
+		slog.Warn("invalid groups capability", "error", err)
+		return nil
+	}
+
+	var groups []string
+	for _, v := range values {
+		groups = append(groups, v.Groups...)
+	}
+	return groups
+}
+
+// matchUser returns the rule matching login. A rule is either a full login
+// name or *@domain to match every user of a domain.
+func matchUser(rules []string, login string) string {
+	if login == "" {
+		return ""
+	}
+	for _, rule := range rules {
+		if domain, ok := strings.CutPrefix(rule, "*@"); ok {
+			if _, d, _ := strings.Cut(login, "@"); strings.EqualFold(d, domain) {
+				return rule
+			}
+		} else if strings.EqualFold(rule, login) {
+			return rule
+		}
+	}
+	return ""
+}
+
+// matchAny returns the first rule found in values
+func matchAny(rules, values []string) string {
+	for _, rule := range rules {
+		if slices.Contains(values, rule) {
+			return rule
+		}
+	}
+	return ""
+}
+
+// serveForbidden writes the page shown to callers rejected by the access policy
+func serveForbidden(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusForbidden)
+	fmt.Fprint(w, forbiddenPage)
+}
+
+const forbiddenPage = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Access denied</title>
+</head>
+<body style="font-family: sans-serif; text-align: center; margin-top: 20vh">
+<h1>Access denied</h1>
+<p>You do not have permission to access this service.</p>
+</body>
+</html>
+`
@@ -0,0 +1,69 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import "testing"
+
+func TestPortMapListFlagEmptyValue(t *testing.T) {
+	https := NewPortMapListFlag(443, 8080)
+	if err := https.Set(""); err != nil {
+		t.Fatalf("empty -https-port: %v", err)
+	}
+	if m := https.Maps[0]; m.In != 443 || m.Out != 8080 {
+		t.Errorf("empty -https-port = %s, want 443:8080", m)
+	}
+
+	tcp := NewPortMapListFlag(0, 0)
+	if err := tcp.Set(""); err == nil {
+		t.Errorf("empty -tcp = %s, want error", tcp)
+	}
+	if tcp.IsSet() {
+		t.Error("empty -tcp added a mapping")
+	}
+}
+
+func TestValidateListenerPorts(t *testing.T) {
+	oldHTTP, oldHTTPS, oldTCP := flagHttp.Maps, flagHttps.Maps, flagTCP.Maps
+	oldMetrics := *flagMetricsAddr
+	t.Cleanup(func() {
+		flagHttp.Maps, flagHttps.Maps, flagTCP.Maps = oldHTTP, oldHTTPS, oldTCP
+		*flagMetricsAddr = oldMetrics
+	})
+
+	tests := []struct {
+		http, https, tcp []string
+		metrics          string
+		wantErr          string
+	}{
+		{http: []string{"80:8080"}, https: []string{"443:8080"}, tcp: []string{"5432"}},
+		{https: []string{"443:8080", "443:9090"}, wantErr: "port 443 is used by both -https-port and -https-port"},
+		{http: []string{"8080"}, tcp: []string{"8080:5432"}, wantErr: "port 8080 is used by both -http-port and -tcp"},
+		{tcp: []string{"9100"}, metrics: ":9100", wantErr: "port 9100 is used by both -tcp and -metrics-addr"},
+		{tcp: []string{"9100"}, metrics: "127.0.0.1:9100"},
+	}
+	for _, tt := range tests {
+		flagHttp.Maps, flagHttps.Maps, flagTCP.Maps = nil, nil, nil
+		for _, v := range tt.http {
+			flagHttp.Set(v)
+		}
+		for _, v := range tt.https {
+			flagHttps.Set(v)
+		}
+		for _, v := range tt.tcp {
+			flagTCP.Set(v)
+		}
+		*flagMetricsAddr = tt.metrics
+
+		err := validateListenerPorts()
+		if tt.wantErr == "" {
+			if err != nil {
+				t.Errorf("%+v: %v", tt, err)
+			}
+			continue
+		}
+		if err == nil || err.Error() != tt.wantErr {
+			t.Errorf("%+v: got error %v, want %q", tt, err, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,153 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"sync/atomic"
+	"time"
+)
+
+// readiness tracks whether the upstream has passed its readiness probe.
+// A readiness without a probe is always ready.
+type readiness struct {
+	ready    atomic.Bool
+	probeURL *url.URL
+	interval time.Duration
+}
+
+// newReadiness creates a readiness from a probe URL in the format
+// tcp://host:port or http://host:port/path. An empty probe means the
+// upstream is considered ready immediately.
+func newReadiness(probe string, interval time.Duration) (*readiness, error) {
+	rd := &readiness{interval: interval}
+	if probe == "" {
+		rd.ready.Store(true)
+		return rd, nil
+	}
+
+	u, err := url.Parse(probe)
+	if err != nil {
+		return nil, fmt.Errorf("invalid readiness probe: %w", err)
+	}
+	switch u.Scheme {
+	case "tcp", "http", "https":
+	default:
+		return nil, fmt.Errorf("unsupported readiness probe scheme %q, expected tcp, http or https", u.Scheme)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("readiness probe is missing host:port: %s", probe)
+	}
+	if interval <= 0 {
+		return nil, fmt.Errorf("readiness interval must be positive")
+	}
+
+	rd.probeURL = u
+	return rd, nil
+}
+
+// Ready reports whether the upstream is accepting traffic
+func (rd *readiness) Ready() bool {
+	return rd.ready.Load()
+}
+
+// reset marks the upstream as not ready so the probe must pass again.
+// It does nothing when there is no probe.
+func (rd *readiness) reset() {
+	if rd.probeURL != nil {
+		rd.ready.Store(false)
+	}
+}
+
+// wait runs the probe until it passes or ctx is cancelled
+func (rd *readiness) wait(ctx context.Context) {
+	if rd.probeURL == nil {
+		return
+	}
+
+	slog.Info("waiting for upstream to become ready", "probe", rd.probeURL.String())
+	start := time.Now()
+
+	ticker := time.NewTicker(rd.interval)
+	defer ticker.Stop()
+
+	for {
+		err := rd.probe(ctx)
+		if err == nil {
+			rd.ready.Store(true)
+			slog.Info("upstream ready", "after", time.Since(start).Round(time.Millisecond))
+			return
+		}
+		slog.Debug("readiness probe failed", "error", err)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// probe checks the upstream once
+func (rd *readiness) probe(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+
+	if rd.probeURL.Scheme == "tcp" {
+		conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", rd.probeURL.Host)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rd.probeURL.String(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		return fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+	return nil
+}
+
+// gate serves a "starting up" page until the upstream is ready
+func (rd *readiness) gate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if rd.Ready() {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Set("Retry-After", "2")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprint(w, startingPage)
+	})
+}
+
+const startingPage = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta http-equiv="refresh" content="2">
+<title>Starting up</title>
+</head>
+<body style="font-family: sans-serif; text-align: center; margin-top: 20vh">
+<h1>Starting up&hellip;</h1>
+<p>The service is not ready yet. This page will refresh automatically.</p>
+</body>
+</html>
+`
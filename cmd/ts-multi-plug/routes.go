@@ -0,0 +1,173 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Route sends requests under a path prefix to a localhost port
+type Route struct {
+	Prefix string
+	Port   int
+
+	// Strip removes Prefix from the request path before proxying
+	Strip bool
+}
+
+// pathHasPrefix reports whether path is prefix or below it. The prefix only
+// matches on path segment boundaries so /api does not match /apix.
+func pathHasPrefix(path, prefix string) bool {
+	prefix = strings.TrimSuffix(prefix, "/")
+	if prefix == "" {
+		return true
+	}
+	if !strings.HasPrefix(path, prefix) {
+		return false
+	}
+	return len(path) == len(prefix) || path[len(prefix)] == '/'
+}
+
+// parseRoute parses a route in the format "/prefix=port"
+func parseRoute(value string, strip bool) (Route, error) {
+	prefix, portStr, ok := strings.Cut(value, "=")
+	if !ok {
+		return Route{}, fmt.Errorf("invalid route format, expected /prefix=port: %s", value)
+	}
+	if !strings.HasPrefix(prefix, "/") {
+		return Route{}, fmt.Errorf("route prefix must start with /: %s", prefix)
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return Route{}, fmt.Errorf("invalid route port format: %s", portStr)
+	}
+	if port < 1 || port > 65535 {
+		return Route{}, fmt.Errorf("route port out of range (1-65535): %s", portStr)
+	}
+
+	if prefix != "/" {
+		prefix = strings.TrimSuffix(prefix, "/")
+	}
+
+	return Route{Prefix: prefix, Port: port, Strip: strip}, nil
+}
+
+// RouteListFlag is a repeatable flag of path routes
+type RouteListFlag struct {
+	Routes []Route
+}
+
+func (r *RouteListFlag) String() string {
+	parts := make([]string, len(r.Routes))
+	for i, rt := range r.Routes {
+		parts[i] = fmt.Sprintf("%s=%d", rt.Prefix, rt.Port)
+	}
+	return strings.Join(parts, ",")
+}
+
+func (r *RouteListFlag) IsSet() bool {
+	return len(r.Routes) > 0
+}
+
+func (r *RouteListFlag) Set(value string) error {
+	return r.add(value, false)
+}
+
+func (r *RouteListFlag) add(value string, strip bool) error {
+	rt, err := parseRoute(value, strip)
+	if err != nil {
+		return err
+	}
+	r.Routes = append(r.Routes, rt)
+	return nil
+}
+
+// StripFlag returns a flag.Value that adds routes to r with prefix
+// stripping enabled
+func (r *RouteListFlag) StripFlag() *stripRouteFlag {
+	return &stripRouteFlag{r}
+}
+
+type stripRouteFlag struct {
+	*RouteListFlag
+}
+
+func (s *stripRouteFlag) String() string {
+	if s.RouteListFlag == nil {
+		return ""
+	}
+	return s.RouteListFlag.String()
+}
+
+func (s *stripRouteFlag) Set(value string) error {
+	return s.add(value, true)
+}
+
+// createRouter creates a handler that sends each request to the upstream of
+// the longest matching route. Requests that match no route go to fallback.
+func createRouter(routes []Route, fallback http.Handler) http.Handler {
+	type routeHandler struct {
+		Route
+		escapedPrefix string
+		handler       http.Handler
+	}
+
+	handlers := make([]routeHandler, len(routes))
+	for i, rt := range routes {
+		escaped := (&url.URL{Path: rt.Prefix}).EscapedPath()
+		handlers[i] = routeHandler{rt, escaped, createReverseProxy(rt.Port)}
+	}
+
+	// longest prefix first so the most specific route wins
+	sort.SliceStable(handlers, func(i, j int) bool {
+		return len(handlers[i].Prefix) > len(handlers[j].Prefix)
+	})
+
+	// routes match on the escaped path so an encoded slash, as in
+	// /api%2Fx, is part of a segment and not a segment boundary
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, h := range handlers {
+			if !pathHasPrefix(r.URL.EscapedPath(), h.escapedPrefix) {
+				continue
+			}
+			if h.Strip && h.Prefix != "/" {
+				r = stripPrefix(r, h.escapedPrefix)
+			}
+			h.handler.ServeHTTP(w, r)
+			return
+		}
+		fallback.ServeHTTP(w, r)
+	})
+}
+
+// stripPrefix returns a shallow copy of r with the escaped prefix removed
+// from the path. The decoded path is rebuilt from what is left so both
+// forms stay in step.
+func stripPrefix(r *http.Request, prefix string) *http.Request {
+	r2 := new(http.Request)
+	*r2 = *r
+	r2.URL = new(url.URL)
+	*r2.URL = *r.URL
+
+	rest := strings.TrimPrefix(r.URL.EscapedPath(), prefix)
+	if !strings.HasPrefix(rest, "/") {
+		rest = "/" + rest
+	}
+	path, err := url.PathUnescape(rest)
+	if err != nil {
+		// EscapedPath only returns valid escapes
+		path = rest
+	}
+	r2.URL.Path = path
+	r2.URL.RawPath = ""
+	if r2.URL.EscapedPath() != rest {
+		r2.URL.RawPath = rest
+	}
+	return r2
+}
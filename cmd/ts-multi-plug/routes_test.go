@@ -0,0 +1,80 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+func TestParseRoute(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    Route
+		wantErr bool
+	}{
+		{value: "/api=9000", want: Route{Prefix: "/api", Port: 9000}},
+		{value: "/api/=9000", want: Route{Prefix: "/api", Port: 9000}},
+		{value: "/=3000", want: Route{Prefix: "/", Port: 3000}},
+		{value: "/api=65535", want: Route{Prefix: "/api", Port: 65535}},
+		{value: "/api=0", wantErr: true},
+		{value: "/api=99999", wantErr: true},
+		{value: "/api=-1", wantErr: true},
+		{value: "/api=http", wantErr: true},
+		{value: "api=9000", wantErr: true},
+		{value: "/api", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseRoute(tt.value, false)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("parseRoute(%q) = %+v, want error", tt.value, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseRoute(%q): %v", tt.value, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("parseRoute(%q) = %+v, want %+v", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestRouterEncodedSlash(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "api "+r.URL.EscapedPath())
+	}))
+	defer upstream.Close()
+	_, portStr, _ := net.SplitHostPort(upstream.Listener.Addr().String())
+	port, _ := strconv.Atoi(portStr)
+
+	fallback := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "fallback "+r.URL.EscapedPath())
+	})
+	router := createRouter([]Route{{Prefix: "/api", Port: port, Strip: true}}, fallback)
+
+	tests := []struct {
+		target string
+		want   string
+	}{
+		{"/api", "api /"},
+		{"/api/x", "api /x"},
+		{"/api/a%2Fb", "api /a%2Fb"},
+		{"/api%2Fx", "fallback /api%2Fx"},
+		{"/apix", "fallback /apix"},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", tt.target, nil))
+		if got := w.Body.String(); got != tt.want {
+			t.Errorf("GET %s = %q, want %q", tt.target, got, tt.want)
+		}
+	}
+}
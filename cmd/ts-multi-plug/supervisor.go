@@ -0,0 +1,269 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// restartPolicy controls when the upstream command is restarted after it exits
+type restartPolicy string
+
+const (
+	restartNever     restartPolicy = "never"
+	restartOnFailure restartPolicy = "on-failure"
+	restartAlways    restartPolicy = "always"
+)
+
+// maxRestartDelay caps the exponential backoff between restarts
+const maxRestartDelay = time.Minute
+
+// errStopping is returned by start when the supervisor has been stopped
+var errStopping = errors.New("supervisor is stopping")
+
+// parseRestartPolicy validates a -restart flag value
+func parseRestartPolicy(value string) (restartPolicy, error) {
+	switch p := restartPolicy(value); p {
+	case restartNever, restartOnFailure, restartAlways:
+		return p, nil
+	default:
+		return "", fmt.Errorf("unknown restart policy %q, expected never, on-failure or always", value)
+	}
+}
+
+// supervisor runs the upstream command and restarts it according to
+// the restart policy. The tsnet server and listeners are not touched so the
+// hostname and certificates are kept across restarts.
+type supervisor struct {
+	args        []string
+	policy      restartPolicy
+	maxRestarts int // 0 means unlimited
+	delay       time.Duration
+	grace       time.Duration
+	ready       *readiness
+	env         []string // added to the environment of the command
+
+	mu        sync.Mutex
+	cmd       *exec.Cmd
+	logWait   func()
+	running   bool
+	startedAt time.Time     // start of the running command
+	stopped   chan struct{} // closed by stop
+	killTimer *time.Timer
+}
+
+// newSupervisor creates a supervisor for the command in args
+func newSupervisor(args []string) *supervisor {
+	return &supervisor{
+		args:    args,
+		stopped: make(chan struct{}),
+	}
+}
+
+// start starts a new instance of the command in its own process group
+func (s *supervisor) start() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.isStopping() {
+		return errStopping
+	}
+
+	cmd := exec.Command(s.args[0], s.args[1:]...)
+	cmd.Env = append(os.Environ(), "TSPLUG_ACTIVE=1")
+	cmd.Env = append(cmd.Env, s.env...)
+	setProcessGroup(cmd)
+	logWait, err := attachLogging(cmd)
+	if err != nil {
+		return fmt.Errorf("failed to attach logging to cmd: %w", err)
+	}
+
+	slog.Info("starting command", "cmd", strings.Join(s.args, " "))
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("command start failed: %w", err)
+	}
+	slog.Info("command started", "pid", cmd.Process.Pid)
+
+	s.cmd = cmd
+	s.logWait = logWait
+	s.running = true
+	s.startedAt = time.Now()
+	return nil
+}
+
+// run waits for the command started by start to exit and restarts it until
+// the policy says to stop, the retry limit is reached or the supervisor is
+// stopped. Cancelling ctx stops the command gracefully with SIGTERM.
+// It returns the error from the last run of the command.
+func (s *supervisor) run(ctx context.Context) error {
+	stopOnCancel := context.AfterFunc(ctx, func() {
+		s.stop(syscall.SIGTERM)
+	})
+	defer stopOnCancel()
+
+	delay := s.delay
+	restarts := 0
+
+	for {
+		started := time.Now()
+
+		readyCtx, cancelReady := context.WithCancel(ctx)
+		go s.ready.wait(readyCtx)
+
+		s.logWait()
+		err := s.cmd.Wait()
+		cancelReady()
+		s.ready.reset()
+		s.exited()
+
+		slog.Info("command exited", "error", err, "uptime", time.Since(started).Round(time.Millisecond))
+		if s.isStopping() || !s.shouldRestart(err) {
+			return err
+		}
+		if s.maxRestarts > 0 && restarts >= s.maxRestarts {
+			slog.Error("command restart limit reached", "restarts", restarts)
+			return err
+		}
+
+		// a command that stayed up for a while is healthy, start the backoff over
+		if time.Since(started) > maxRestartDelay {
+			delay = s.delay
+		}
+
+		restarts++
+		childRestarts.Add(1)
+		slog.Info("restarting command", "attempt", restarts, "delay", delay)
+		select {
+		case <-s.stopped:
+			return err
+		case <-time.After(delay):
+		}
+		delay = min(delay*2, maxRestartDelay)
+
+		if startErr := s.start(); startErr != nil {
+			if errors.Is(startErr, errStopping) {
+				return err
+			}
+			return startErr
+		}
+	}
+}
+
+// stop forwards sig to the command's process group and prevents any further
+// restarts. If the command is still running after the grace period its
+// process group is killed.
+func (s *supervisor) stop(sig os.Signal) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.isStopping() {
+		close(s.stopped)
+	}
+	if !s.running {
+		return
+	}
+
+	slog.Info("forwarding signal to command", "sig", sig.String(), "pid", s.cmd.Process.Pid)
+	if err := signalProcessGroup(s.cmd, sig); err != nil {
+		slog.Error("failed to signal command", "error", err)
+	}
+
+	if s.killTimer == nil {
+		cmd := s.cmd
+		s.killTimer = time.AfterFunc(s.grace, func() {
+			slog.Warn("command did not exit within grace period, killing it", "grace", s.grace)
+			if err := signalProcessGroup(cmd, syscall.SIGKILL); err != nil {
+				slog.Error("failed to kill command", "error", err)
+			}
+		})
+	}
+}
+
+// signal forwards sig to the command's process group without stopping it
+// or affecting restarts
+func (s *supervisor) signal(sig os.Signal) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.running {
+		return
+	}
+	slog.Info("forwarding signal to command", "sig", sig.String(), "pid", s.cmd.Process.Pid)
+	if err := signalProcessGroup(s.cmd, sig); err != nil {
+		slog.Error("failed to signal command", "error", err)
+	}
+}
+
+// exited records that the current command has exited
+func (s *supervisor) exited() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.running = false
+	if s.killTimer != nil {
+		s.killTimer.Stop()
+		s.killTimer = nil
+	}
+}
+
+// uptime returns how long the current command has been running, zero when
+// it is not running
+func (s *supervisor) uptime() time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.running {
+		return 0
+	}
+	return time.Since(s.startedAt)
+}
+
+// isStopping reports whether stop has been called
+func (s *supervisor) isStopping() bool {
+	select {
+	case <-s.stopped:
+		return true
+	default:
+		return false
+	}
+}
+
+// shouldRestart reports whether the policy allows a restart after the
+// command exited with err
+func (s *supervisor) shouldRestart(err error) bool {
+	switch s.policy {
+	case restartAlways:
+		return true
+	case restartOnFailure:
+		return err != nil
+	default:
+		return false
+	}
+}
+
+// exitCode converts the error returned by the command into an exit code for
+// ts-plug. A command killed by a signal exits with 128+signal like a shell.
+func exitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) {
+		return 1
+	}
+	if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		return 128 + int(status.Signal())
+	}
+	return exitErr.ExitCode()
+}
@@ -0,0 +1,104 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+
+	"tailscale.com/tsnet"
+)
+
+// startTCPListener starts a raw TCP forwarder on the tailnet
+func startTCPListener(ctx context.Context, ts *tsnet.Server, hostname string, portMap *PortMapFlag) error {
+	listener, err := ts.Listen("tcp", fmt.Sprintf(":%d", portMap.In))
+	if err != nil {
+		return fmt.Errorf("failed to listen on TCP port %d: %w", portMap.In, err)
+	}
+	defer listener.Close()
+
+	slog.Info(fmt.Sprintf("listening at (TCP): %s:%d -> 127.0.0.1:%d", hostname, portMap.In, portMap.Out))
+
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
+
+	upstreamAddr := fmt.Sprintf("127.0.0.1:%d", portMap.Out)
+	labels := listenerLabels{Listener: fmt.Sprintf("tcp:%d", portMap.In)}
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return fmt.Errorf("TCP accept error: %w", err)
+		}
+		if !upstreamReady.Ready() {
+			slog.Debug("TCP connection rejected, upstream not ready", "client", conn.RemoteAddr())
+			conn.Close()
+			continue
+		}
+		tcpConnections.Add(labels, 1)
+		go handleTCPConn(ctx, conn, upstreamAddr)
+	}
+}
+
+// handleTCPConn connects to the upstream and copies bytes in both directions
+// until both sides are done or ctx is cancelled
+func handleTCPConn(ctx context.Context, conn net.Conn, upstreamAddr string) {
+	defer conn.Close()
+
+	dialer := &net.Dialer{Timeout: 2 * time.Second}
+	upstreamConn, err := dialer.DialContext(ctx, "tcp", upstreamAddr)
+	if err != nil {
+		slog.Error("failed to connect to upstream TCP", "error", err, "upstream", upstreamAddr)
+		upstreamErrors.Add(upstreamLabels{Upstream: upstreamAddr}, 1)
+		return
+	}
+	defer upstreamConn.Close()
+
+	// close both sides on shutdown so the copies in splice return
+	stop := context.AfterFunc(ctx, func() {
+		conn.Close()
+		upstreamConn.Close()
+	})
+	defer stop()
+
+	slog.Debug("TCP connection opened", "client", conn.RemoteAddr(), "upstream", upstreamAddr)
+	splice(conn, upstreamConn)
+	slog.Debug("TCP connection closed", "client", conn.RemoteAddr(), "upstream", upstreamAddr)
+}
+
+// splice copies data between a and b in both directions. When one side
+// reaches EOF the write half of the other side is closed so the peer sees
+// the half-close, and splice returns once both directions are finished.
+func splice(a, b net.Conn) {
+	var wg sync.WaitGroup
+	wg.Go(func() { copyHalf(a, b) })
+	wg.Go(func() { copyHalf(b, a) })
+	wg.Wait()
+}
+
+// copyHalf copies src to dst then closes the write side of dst
+func copyHalf(dst, src net.Conn) {
+	if _, err := io.Copy(dst, src); err != nil {
+		slog.Debug("TCP copy ended", "error", err)
+	}
+	closeWrite(dst)
+}
+
+// closeWrite closes the write side of c, or all of c if it can't half-close
+func closeWrite(c net.Conn) {
+	if cw, ok := c.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+	} else {
+		c.Close()
+	}
+}
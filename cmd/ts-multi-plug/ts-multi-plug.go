@@ -6,50 +6,147 @@ package main
 import (
 	"bufio"
 	"context"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"log/slog"
 	"net"
 	"net/http"
 	"net/http/httputil"
+	"net/netip"
 	"net/url"
 	"os"
 	"os/exec"
 	"os/signal"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
+	"github.com/mostlygeek/ts-plug/internal/tsauth"
 	"tailscale.com/client/local"
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/ipn/store/mem"
+	"tailscale.com/tailcfg"
 	"tailscale.com/tsnet"
 )
 
 var (
+	flagConfig     = flag.String("config", "", "path to a HuJSON config file, command line flags take precedence")
 	flagHostname   string
 	flagDir        string
 	flagLogLevel   string
 	flagDebugTSNet = flag.Bool("debug-tsnet", false, "enable tsnet.Server logging")
 
+	// node registration flags
+	flagAuthKey       = flag.String("authkey", "", "auth key to register the node (default $TS_AUTHKEY)")
+	flagClientSecret  = flag.String("client-secret", "", "OAuth client secret used to create an auth key, requires -advertise-tags (default $TS_CLIENT_SECRET)")
+	flagAdvertiseTags = flag.String("advertise-tags", "", "comma separated ACL tags to request for the node (tag:a,tag:b)")
+	flagControlURL    = flag.String("control-url", "", "coordination server URL, for self-hosted control servers such as Headscale")
+	flagEphemeral     = flag.Bool("ephemeral", false, "register as an ephemeral node with in-memory state that is removed on exit")
+
 	// HTTP flags
 	httpEnable = flag.Bool("http", false, "Enable HTTP listener (default 80:8080)")
-	flagHttp   = NewPortMapFlag(80, 8080)
+	flagHttp   = NewPortMapListFlag(80, 8080)
 
 	// HTTPS flags
 	httpsEnable = flag.Bool("https", false, "Enable HTTPS listener (default 443:8080)")
-	flagHttps   = NewPortMapFlag(443, 8080)
+	flagHttps   = NewPortMapListFlag(443, 8080)
 
 	// DNS flags
 	dnsEnable = flag.Bool("dns", false, "Enable DNS listener (default 53:53)")
 	flagDNS   = NewPortMapFlag(53, 53)
 
+	flagDNSCacheSize = flag.Int("dns-cache-size", 0, "cache up to this many DNS responses, 0 disables the cache")
+	flagDNSQueryLog  = flag.String("dns-query-log", "", "write a JSON entry for every DNS query to stdout, stderr or a file")
+
+	flagDNSQueryLogMaxSize    = flag.Int("dns-query-log-max-size", 100, "rotate the DNS query log file after this many megabytes, 0 to never rotate")
+	flagDNSQueryLogMaxBackups = flag.Int("dns-query-log-max-backups", 5, "number of rotated DNS query log files to keep")
+
+	// TCP flags
+	flagTCP = NewPortMapListFlag(0, 0)
+
 	flagPublic = flag.Bool("public", false, "Enable public https access")
+
+	// public Funnel listeners, separate from the tailnet HTTPS listeners
+	flagFunnel       = NewPortMapListFlag(443, 8080)
+	flagFunnelRoutes = &RouteListFlag{}
+	flagFunnelOnly   = flag.Bool("funnel-only", false, "only accept public Funnel connections on Funnel listeners, not tailnet peers")
+
+	// paths Funnel requests may reach, empty allows all
+	flagFunnelPaths StringListFlag
+
+	// routing flags
+	flagRoutes = &RouteListFlag{}
+
+	// readiness flags
+	flagReadyCheck    = flag.String("ready-check", "", "probe that must pass before traffic is sent upstream (tcp://host:port or http://host:port/path)")
+	flagReadyInterval = flag.Duration("ready-interval", time.Second, "time between readiness probes")
+
+	// upstreamReady gates traffic to the upstream until its readiness probe passes
+	upstreamReady *readiness
+
+	// restart flags
+	flagRestart      = flag.String("restart", "never", "restart the command when it exits (never | on-failure | always)")
+	flagRestartMax   = flag.Int("restart-max", 0, "maximum number of restarts, 0 for unlimited")
+	flagRestartDelay = flag.Duration("restart-delay", time.Second, "initial delay between restarts, doubled after each restart")
+
+	// access control, applied to every HTTP and HTTPS listener
+	accessRules = &accessPolicy{}
+
+	// app capabilities forwarded to the upstream
+	flagAppCaps StringListFlag
+
+	// identity assertion flags
+	flagAssertion    = flag.Bool("identity-assertion", false, "send a signed JWT with the caller identity in the Tailscale-Identity-Assertion header")
+	flagAssertionTTL = flag.Duration("identity-assertion-ttl", time.Minute, "lifetime of identity assertion JWTs")
+	flagJWKSPath     = flag.String("identity-assertion-jwks-path", defaultJWKSPath, "path the identity assertion public keys are served at instead of the upstream, empty to not serve them")
+
+	// access log flags
+	flagAccessLog           = flag.String("access-log", "", "write an access log entry for every HTTP request to stdout, stderr or a file")
+	flagAccessLogFormat     = flag.String("access-log-format", "logfmt", "access log format (json | logfmt | combined)")
+	flagAccessLogMaxSize    = flag.Int("access-log-max-size", 100, "rotate the access log file after this many megabytes, 0 to never rotate")
+	flagAccessLogMaxBackups = flag.Int("access-log-max-backups", 5, "number of rotated access log files to keep")
+
+	// accessLog writes the access log, nil when it is disabled
+	accessLog *slog.Logger
+
+	// dnsQueryLog writes the DNS query log, nil when it is disabled
+	dnsQueryLog *slog.Logger
+
+	// assertions signs identity assertions, nil when they are disabled
+	assertions *assertionSigner
+
+	flagMetricsAddr = flag.String("metrics-addr", "", "serve Prometheus metrics at /metrics, :port listens on the tailnet only and 127.0.0.1:port on localhost")
+
+	flagGracePeriod = flag.Duration("grace-period", 10*time.Second, "time to wait for the command to exit after a signal before killing it")
 )
 
 func init() {
-	flag.Var(flagHttp, "http-port", "HTTP port mapping (in:out or port)")
-	flag.Var(flagHttps, "https-port", "HTTPS port mapping (in:out or port)")
+	flag.Var(flagHttp, "http-port", "HTTP port mapping (in:out or port), repeatable")
+	flag.Var(flagHttps, "https-port", "HTTPS port mapping (in:out or port), repeatable")
 	flag.Var(flagDNS, "dns-port", "DNS port mapping (in:out or port)")
+	flag.Var(flagTCP, "tcp", "raw TCP port mapping (in:out or port), repeatable")
+	flag.Var(flagRoutes, "route", "route a path prefix to a localhost port (/prefix=port), repeatable")
+	flag.Var(flagRoutes.StripFlag(), "route-strip", "like -route but strips the prefix before proxying, repeatable")
+
+	flag.Var(&accessRules.AllowUsers, "allow-user", "only allow these users (login or *@domain), repeatable")
+	flag.Var(&accessRules.AllowGroups, "allow-group", "only allow these groups (group:name) granted via the app capability, repeatable")
+	flag.Var(&accessRules.AllowTags, "allow-tag", "only allow nodes with these tags (tag:name), repeatable")
+	flag.Var(&accessRules.DenyUsers, "deny-user", "deny these users (login or *@domain), repeatable")
+	flag.Var(&accessRules.DenyGroups, "deny-group", "deny these groups (group:name) granted via the app capability, repeatable")
+	flag.Var(&accessRules.DenyTags, "deny-tag", "deny nodes with these tags (tag:name), repeatable")
+
+	flag.Var(flagFunnel, "funnel-port", "public Funnel HTTPS port mapping (in:out or port), in must be 443, 8443 or 10000, repeatable")
+	flag.Var(flagFunnelRoutes, "funnel-route", "like -route but only for -funnel-port listeners, repeatable")
+	flag.Var(flagFunnelRoutes.StripFlag(), "funnel-route-strip", "like -route-strip but only for -funnel-port listeners, repeatable")
+	flag.Var(&flagFunnelPaths, "funnel-allow-path", "only allow public Funnel requests to this path prefix, repeatable")
+
+	flag.Var(&flagAppCaps, "app-capability", "app capability to forward in the Tailscale-App-Capabilities header, repeatable")
 
 	flag.StringVar(&flagHostname, "hostname", "tsmultiplug", "hostname on tailnet")
 	flag.StringVar(&flagHostname, "hn", "tsmultiplug", "hostname on tailnet (short)")
@@ -60,30 +157,36 @@ func init() {
 func main() {
 	flag.Parse()
 
-	// Set log level
-	switch flagLogLevel {
-	case "debug":
-		slog.SetLogLoggerLevel(slog.LevelDebug)
-	case "info":
-		slog.SetLogLoggerLevel(slog.LevelInfo)
-	case "warn":
-		slog.SetLogLoggerLevel(slog.LevelWarn)
-	case "error":
-		slog.SetLogLoggerLevel(slog.LevelError)
-	default:
-		slog.Error("unknown log level", slog.String("level", flagLogLevel))
-		os.Exit(1)
+	// Everything after "--" goes into cmdArgs. Without a command ts-plug runs
+	// in proxy-only mode in front of an already running service
+	cmdArgs := flag.Args()
+
+	// Fill in anything not given on the command line from the config file
+	if *flagConfig != "" {
+		cfg, err := loadConfig(*flagConfig)
+		if err != nil {
+			slog.Error("failed to load config", "error", err)
+			os.Exit(1)
+		}
+		if err := cfg.apply(); err != nil {
+			slog.Error("invalid config", "file", *flagConfig, "error", err)
+			os.Exit(1)
+		}
+		if len(cmdArgs) == 0 {
+			cmdArgs = cfg.Command
+		}
 	}
 
-	// Everything after "--" goes into cmdArgs
-	cmdArgs := flag.Args()
-	if len(cmdArgs) == 0 {
-		slog.Error("no command to run")
+	// Set log level
+	level, err := parseLogLevel(flagLogLevel)
+	if err != nil {
+		slog.Error("unknown log level", slog.String("level", flagLogLevel))
 		os.Exit(1)
 	}
+	slog.SetLogLoggerLevel(level)
 
 	// Check that at least one listener is enabled
-	if !flagHttp.IsSet() && !flagHttps.IsSet() && !flagDNS.IsSet() {
+	if !flagHttp.IsSet() && !flagHttps.IsSet() && !flagFunnel.IsSet() && !flagDNS.IsSet() && !flagTCP.IsSet() {
 		slog.Info("no listeners enabled, using HTTPS by default")
 		*httpsEnable = true
 	}
@@ -99,8 +202,134 @@ func main() {
 		flagDNS.Set("")
 	}
 
-	// cmdExitChannel receives the error when cmd.Wait() return
-	cmdExitChan := make(chan error)
+	upstreamReady, err = newReadiness(*flagReadyCheck, *flagReadyInterval)
+	if err != nil {
+		slog.Error("invalid readiness check", "error", err)
+		os.Exit(1)
+	}
+
+	if *flagMetricsAddr != "" {
+		if err := validateMetricsAddr(*flagMetricsAddr); err != nil {
+			slog.Error("invalid metrics address", "error", err)
+			os.Exit(1)
+		}
+	}
+
+	if *flagAccessLog != "" {
+		if *flagAccessLogMaxSize < 0 || *flagAccessLogMaxBackups < 0 {
+			slog.Error("invalid access log rotation, sizes must not be negative")
+			os.Exit(1)
+		}
+		accessLog, err = newAccessLogger(*flagAccessLog, *flagAccessLogFormat, *flagAccessLogMaxSize, *flagAccessLogMaxBackups)
+		if err != nil {
+			slog.Error("failed to create access log", "error", err)
+			os.Exit(1)
+		}
+	}
+
+	if *flagDNSCacheSize < 0 {
+		slog.Error("invalid DNS cache size, must not be negative", "size", *flagDNSCacheSize)
+		os.Exit(1)
+	}
+
+	if *flagDNSQueryLog != "" {
+		if *flagDNSQueryLogMaxSize < 0 || *flagDNSQueryLogMaxBackups < 0 {
+			slog.Error("invalid DNS query log rotation, sizes must not be negative")
+			os.Exit(1)
+		}
+		if sameLogFile(*flagDNSQueryLog, *flagAccessLog) {
+			slog.Error("the DNS query log and the access log must be different files", "file", *flagDNSQueryLog)
+			os.Exit(1)
+		}
+		dnsQueryLog, err = newAccessLogger(*flagDNSQueryLog, "json", *flagDNSQueryLogMaxSize, *flagDNSQueryLogMaxBackups)
+		if err != nil {
+			slog.Error("failed to create DNS query log", "error", err)
+			os.Exit(1)
+		}
+	}
+
+	if err := validateListenerPorts(); err != nil {
+		slog.Error("invalid listener", "error", err)
+		os.Exit(1)
+	}
+
+	if err := validateFunnelListeners(); err != nil {
+		slog.Error("invalid funnel listener", "error", err)
+		os.Exit(1)
+	}
+
+	if err := validateFunnelPaths(flagFunnelPaths); err != nil {
+		slog.Error("invalid funnel paths", "error", err)
+		os.Exit(1)
+	}
+
+	if *flagJWKSPath != "" && !strings.HasPrefix(*flagJWKSPath, "/") {
+		slog.Error("invalid JWKS path, must start with /", "path", *flagJWKSPath)
+		os.Exit(1)
+	}
+
+	if err := accessRules.validate(); err != nil {
+		slog.Error("invalid access policy", "error", err)
+		os.Exit(1)
+	}
+	if accessRules.enabled() && (*flagPublic || flagFunnel.IsSet()) && len(flagFunnelPaths) == 0 {
+		slog.Warn("the access policy only applies to tailnet callers, use -funnel-allow-path to limit public Funnel requests")
+	}
+
+	if err := tsauth.ValidateControlURL(*flagControlURL); err != nil {
+		slog.Error("invalid control URL", "error", err)
+		os.Exit(1)
+	}
+	tags, err := tsauth.ParseTags(*flagAdvertiseTags)
+	if err != nil {
+		slog.Error("invalid advertise tags", "error", err)
+		os.Exit(1)
+	}
+	authKey, err := tsauth.ResolveAuthKey(*flagAuthKey, *flagClientSecret, tags)
+	if err != nil {
+		slog.Error("invalid auth configuration", "error", err)
+		os.Exit(1)
+	}
+
+	policy, err := parseRestartPolicy(*flagRestart)
+	if err != nil {
+		slog.Error("invalid restart policy", "error", err)
+		os.Exit(1)
+	}
+	if *flagRestartDelay <= 0 {
+		slog.Error("restart delay must be positive")
+		os.Exit(1)
+	}
+
+	// ephemeral nodes keep their state in memory and anything else tsnet
+	// writes goes to a temporary directory, so nothing is left in -dir
+	stateDir := flagDir
+	if *flagEphemeral {
+		stateDir, err = os.MkdirTemp("", "ts-plug-")
+		if err != nil {
+			slog.Error("failed to create temporary state directory", "error", err)
+			os.Exit(1)
+		}
+	}
+
+	// the signing key is kept in the state directory so upstreams can keep
+	// trusting it across restarts. With -ephemeral it is deleted on exit.
+	var cmdEnv []string
+	if *flagAssertion {
+		assertions, err = loadAssertionSigner(stateDir, *flagAssertionTTL)
+		if err != nil {
+			slog.Error("failed to load identity assertion key", "error", err)
+			if *flagEphemeral {
+				os.RemoveAll(stateDir)
+			}
+			os.Exit(1)
+		}
+		cmdEnv = append(cmdEnv, "TSPLUG_JWKS_FILE="+filepath.Join(stateDir, jwksFile))
+	}
+
+	// cmdExitChannel receives the error when the supervisor stops running the
+	// command, or nil on shutdown in proxy-only mode
+	cmdExitChan := make(chan error, 1)
 
 	// signalChan receives OS signals for shutdown
 	signalChan := make(chan os.Signal, 1)
@@ -109,42 +338,76 @@ func main() {
 	// create a context that can be cancelled to stop upstream and tsnet
 	ctx, cancelCtx := context.WithCancel(context.Background())
 
-	// start the child process that will handle requests
-	cmd := exec.CommandContext(ctx, cmdArgs[0], cmdArgs[1:]...)
-	cmd.Env = append(os.Environ(), "TSPLUG_ACTIVE=1")
-	if err := attachLogging(cmd); err != nil {
-		slog.Error("failed to attach logging to cmd", "error", err)
-		os.Exit(1)
-	}
+	var sup *supervisor
+	if len(cmdArgs) > 0 {
+		// start the child process that will handle requests
+		sup = newSupervisor(cmdArgs)
+		sup.policy = policy
+		sup.maxRestarts = *flagRestartMax
+		sup.delay = *flagRestartDelay
+		sup.grace = *flagGracePeriod
+		sup.ready = upstreamReady
+		sup.env = cmdEnv
+		publishSupervisorMetrics(sup)
+		if err := sup.start(); err != nil {
+			slog.Error("failed to start command", "error", err)
+			if *flagEphemeral {
+				os.RemoveAll(stateDir)
+			}
+			os.Exit(1)
+		}
 
-	slog.Info("starting command", "cmd", strings.Join(cmdArgs, " "))
-	if err := cmd.Start(); err != nil {
-		slog.Error("command start failed", "error", err)
-		os.Exit(1)
+		// supervise the command, restarting it according to the restart policy.
+		// Once it has stopped for good cancel ctx to shut down the listeners and tsnet
+		go func() {
+			cmdExitChan <- sup.run(ctx)
+			cancelCtx()
+		}()
 	} else {
-		slog.Info("command started")
+		slog.Info("no command to run, running in proxy-only mode")
+
+		go upstreamReady.wait(ctx)
+		go func() {
+			<-ctx.Done()
+			cmdExitChan <- nil
+		}()
 	}
 
-	// handle the exit cases either from signal or the upstream command exiting
+	// handle shutdown signals
 	go func() {
-		for {
-			select {
-			case cmdExitChan <- cmd.Wait():
-				// the upstream command has exited
-				return
-			case sig := <-signalChan:
-				slog.Info("signal received, shutting down...", "sig", sig.String())
+		for sig := range signalChan {
+			if sig == syscall.SIGHUP && sup != nil {
+				// commands commonly reload their config on SIGHUP, pass it
+				// on without shutting down
+				sup.signal(sig)
+				continue
+			}
+
+			slog.Info("signal received, shutting down...", "sig", sig.String())
 
-				// this will cause the case above with cmd.Wait() to return
-				// as well ts.Up() to exit early if it hasn't been fully initialized yet
+			if sup == nil {
+				// proxy-only mode, there is no command to wait for
 				cancelCtx()
+				continue
 			}
+
+			// forward the signal to the command. When it exits the supervisor
+			// cancels ctx, which also makes ts.Up() exit early if it hasn't
+			// been fully initialized yet
+			sup.stop(sig)
 		}
 	}()
 
 	ts := &tsnet.Server{
-		Hostname: flagHostname,
-		Dir:      flagDir,
+		Hostname:      flagHostname,
+		Dir:           stateDir,
+		AuthKey:       authKey,
+		AdvertiseTags: tags,
+		ControlURL:    *flagControlURL,
+		Ephemeral:     *flagEphemeral,
+	}
+	if *flagEphemeral {
+		ts.Store = new(mem.Store)
 	}
 
 	if *flagDebugTSNet {
@@ -157,14 +420,23 @@ func main() {
 
 	// start the tsnet server. ts.Up() blocks in a loop calling watcher.Next()
 	// which performs json.Decoder.Decode() on an HTTP response body stream. The
-	// cancellable context passed here ensures that when the signal handler calls
-	// cancelCtx() (lines 89-94), the underlying HTTP request is cancelled, causing
-	// the Decode() to return an error and ts.Up() to exit early. Without a
+	// cancellable context passed here ensures that when the command exits after
+	// a signal and cancelCtx() is called, the underlying HTTP request is cancelled,
+	// causing the Decode() to return an error and ts.Up() to exit early. Without a
 	// cancellable context, ts.Up() would hang indefinitely on SIGINT/SIGTERM
 	st, err := ts.Up(ctx)
 	if err != nil {
+		if ctx.Err() != nil {
+			// the command exited or a signal was received in proxy-only
+			// mode before tsnet finished starting
+			err := <-cmdExitChan
+			closeNode(ts)
+			exitWithCmd(err)
+		}
 		slog.Error("error starting tsnet server", slog.Any("error", err))
 		cancelCtx()
+		<-cmdExitChan
+		closeNode(ts)
 		os.Exit(1)
 	}
 
@@ -172,27 +444,50 @@ func main() {
 	if err != nil {
 		slog.Error("Failed to get tsnet LocalClient", "error", err)
 		cancelCtx()
+		<-cmdExitChan
+		closeNode(ts)
 		os.Exit(1)
 	}
 
 	hostname := strings.TrimSuffix(st.Self.DNSName, ".")
+	if assertions != nil {
+		assertions.issuer = "https://" + hostname
+	}
+
+	// listenerFailed records that ts-plug shut down because one of its own
+	// listeners failed, rather than because of a signal or the command
+	var listenerFailed atomic.Bool
+	failListener := func() {
+		listenerFailed.Store(true)
+		cancelCtx()
+	}
 
-	// Start HTTP listener if enabled
-	if flagHttp.IsSet() {
+	// Start an HTTP listener for each mapping
+	for _, portMap := range flagHttp.Maps {
 		go func() {
-			if err := startHTTPListener(ctx, ts, lc, hostname, flagHttp); err != nil {
+			if err := startHTTPListener(ctx, ts, lc, hostname, portMap); err != nil {
 				slog.Error("HTTP listener failed", "error", err)
-				cancelCtx()
+				failListener()
 			}
 		}()
 	}
 
-	// Start HTTPS listener if enabled
-	if flagHttps.IsSet() {
+	// Start an HTTPS listener for each mapping
+	for _, portMap := range flagHttps.Maps {
 		go func() {
-			if err := startHTTPSListener(ctx, ts, lc, hostname, flagHttps, *flagPublic); err != nil {
+			if err := startHTTPSListener(ctx, ts, lc, hostname, portMap, *flagPublic, flagRoutes.Routes); err != nil {
 				slog.Error("HTTPS listener failed", "error", err)
-				cancelCtx()
+				failListener()
+			}
+		}()
+	}
+
+	// Start a public Funnel listener for each mapping
+	for _, portMap := range flagFunnel.Maps {
+		go func() {
+			if err := startHTTPSListener(ctx, ts, lc, hostname, portMap, true, funnelRoutes()); err != nil {
+				slog.Error("Funnel listener failed", "error", err)
+				failListener()
 			}
 		}()
 	}
@@ -202,13 +497,123 @@ func main() {
 		go func() {
 			if err := startDNSListener(ctx, ts, lc, hostname, flagDNS); err != nil {
 				slog.Error("DNS listener failed", "error", err)
-				cancelCtx()
+				failListener()
+			}
+		}()
+	}
+
+	// Start a TCP forwarder for each mapping
+	for _, portMap := range flagTCP.Maps {
+		go func() {
+			if err := startTCPListener(ctx, ts, hostname, portMap); err != nil {
+				slog.Error("TCP listener failed", "error", err)
+				failListener()
+			}
+		}()
+	}
+
+	// Serve metrics if enabled
+	if *flagMetricsAddr != "" {
+		go func() {
+			if err := startMetricsListener(ctx, ts, hostname, *flagMetricsAddr); err != nil {
+				slog.Error("metrics listener failed", "error", err)
+				failListener()
 			}
 		}()
 	}
 
 	err = <-cmdExitChan
-	slog.Info("cmd exited", "error", err)
+	closeNode(ts)
+	if listenerFailed.Load() {
+		// the command was stopped by ts-plug, its exit code, often 0 after
+		// SIGTERM, would hide the failure from Docker and systemd
+		slog.Info("exiting after a listener failure", "code", 1)
+		os.Exit(1)
+	}
+	exitWithCmd(err)
+}
+
+// validateListenerPorts checks that no two listeners on the tailnet use the
+// same port. DNS counts for its TCP listener and -metrics-addr only when it
+// listens on the tailnet.
+func validateListenerPorts() error {
+	type listener struct {
+		flag string
+		maps []*PortMapFlag
+	}
+	listeners := []listener{
+		{"-http-port", flagHttp.Maps},
+		{"-https-port", flagHttps.Maps},
+		{"-funnel-port", flagFunnel.Maps},
+		{"-tcp", flagTCP.Maps},
+	}
+	if flagDNS.IsSet() {
+		listeners = append(listeners, listener{"-dns-port", []*PortMapFlag{flagDNS}})
+	}
+	if *flagMetricsAddr != "" {
+		host, port, _ := net.SplitHostPort(*flagMetricsAddr)
+		if p, err := strconv.Atoi(port); err == nil && host == "" {
+			listeners = append(listeners, listener{"-metrics-addr", []*PortMapFlag{{In: p}}})
+		}
+	}
+
+	used := make(map[int]string)
+	for _, l := range listeners {
+		for _, m := range l.maps {
+			if other, ok := used[m.In]; ok {
+				return fmt.Errorf("port %d is used by both %s and %s", m.In, other, l.flag)
+			}
+			used[m.In] = l.flag
+		}
+	}
+	return nil
+}
+
+// closeNode shuts down the tsnet server. An ephemeral node is logged out so
+// it is removed from the tailnet right away instead of once it goes idle,
+// and its temporary state directory is deleted.
+func closeNode(ts *tsnet.Server) {
+	if ts.Ephemeral {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		if lc, err := ts.LocalClient(); err == nil {
+			if err := lc.Logout(ctx); err != nil {
+				slog.Warn("failed to log out ephemeral node", "error", err)
+			}
+		}
+	}
+
+	ts.Close()
+
+	if ts.Ephemeral {
+		if err := os.RemoveAll(ts.Dir); err != nil {
+			slog.Warn("failed to remove temporary state directory", "dir", ts.Dir, "error", err)
+		}
+	}
+}
+
+// exitWithCmd exits ts-plug with the exit code of the command
+func exitWithCmd(err error) {
+	code := exitCode(err)
+	slog.Info("exiting", "code", code)
+	os.Exit(code)
+}
+
+// parseLogLevel parses a -log flag value
+func parseLogLevel(value string) (slog.Level, error) {
+	switch value {
+	case "debug":
+		return slog.LevelDebug, nil
+	case "info":
+		return slog.LevelInfo, nil
+	case "warn":
+		return slog.LevelWarn, nil
+	case "error":
+		return slog.LevelError, nil
+	default:
+		return 0, fmt.Errorf("unknown log level %q, expected debug, info, warn or error", value)
+	}
 }
 
 // startHTTPListener starts an HTTP listener on the tailnet
@@ -221,11 +626,8 @@ func startHTTPListener(ctx context.Context, ts *tsnet.Server, lc *local.Client,
 
 	slog.Info(fmt.Sprintf("listening at (HTTP): http://%s:%d", hostname, portMap.In))
 
-	proxy := createReverseProxy(portMap.Out)
-	whoisHandler := createWhoisHandler(lc, proxy)
-
 	httpServer := &http.Server{
-		Handler: whoisHandler,
+		Handler: createListenerHandler(lc, fmt.Sprintf("http:%d", portMap.In), portMap.Out, flagRoutes.Routes),
 	}
 
 	go func() {
@@ -240,18 +642,26 @@ func startHTTPListener(ctx context.Context, ts *tsnet.Server, lc *local.Client,
 	return nil
 }
 
-// startHTTPSListener starts an HTTPS listener on the tailnet
-func startHTTPSListener(ctx context.Context, ts *tsnet.Server, lc *local.Client, hostname string, portMap *PortMapFlag, useFunnel bool) error {
+// startHTTPSListener starts an HTTPS listener on the tailnet. With
+// useFunnel it is also reachable from the public internet.
+func startHTTPSListener(ctx context.Context, ts *tsnet.Server, lc *local.Client, hostname string, portMap *PortMapFlag, useFunnel bool, routes []Route) error {
 	var listener net.Listener
 	var err error
 
 	if useFunnel {
-		listener, err = ts.ListenFunnel("tcp", ":443")
+		var opts []tsnet.FunnelOption
+		label := "FUNNEL HTTPS"
+		if *flagFunnelOnly {
+			opts = append(opts, tsnet.FunnelOnly())
+			label = "FUNNEL ONLY HTTPS"
+		}
+
+		listener, err = ts.ListenFunnel("tcp", fmt.Sprintf(":%d", portMap.In), opts...)
 		if err != nil {
-			return fmt.Errorf("failed to listen to funnel port 443")
+			return fmt.Errorf("failed to listen on funnel port %d: %w", portMap.In, err)
 		}
 		defer listener.Close()
-		slog.Info(fmt.Sprintf("listening at (FUNNEL HTTPS): https://%s", hostname))
+		slog.Info(fmt.Sprintf("listening at (%s): https://%s:%d", label, hostname, portMap.In))
 
 	} else {
 		listener, err = ts.ListenTLS("tcp", fmt.Sprintf(":%d", portMap.In))
@@ -262,11 +672,9 @@ func startHTTPSListener(ctx context.Context, ts *tsnet.Server, lc *local.Client,
 		slog.Info(fmt.Sprintf("listening at (HTTPS): https://%s:%d", hostname, portMap.In))
 	}
 
-	proxy := createReverseProxy(portMap.Out)
-	whoisHandler := createWhoisHandler(lc, proxy)
-
 	httpServer := &http.Server{
-		Handler: whoisHandler,
+		Handler:     createListenerHandler(lc, fmt.Sprintf("https:%d", portMap.In), portMap.Out, routes),
+		ConnContext: funnelConnContext,
 	}
 
 	go func() {
@@ -281,100 +689,6 @@ func startHTTPSListener(ctx context.Context, ts *tsnet.Server, lc *local.Client,
 	return nil
 }
 
-// startDNSListener starts a DNS packet forwarder on the tailnet
-func startDNSListener(ctx context.Context, ts *tsnet.Server, lc *local.Client, hostname string, portMap *PortMapFlag) error {
-	// Get Tailscale status to retrieve our IP address
-	status, err := lc.Status(ctx)
-	if err != nil {
-		return fmt.Errorf("failed to get tailscale status: %w", err)
-	}
-	if len(status.TailscaleIPs) == 0 {
-		return fmt.Errorf("no tailscale IPs available")
-	}
-
-	// Use the first Tailscale IP (typically IPv4)
-	tsIP := status.TailscaleIPs[0]
-
-	// Listen on tailnet side
-	tsConn, err := ts.ListenPacket("udp", fmt.Sprintf("%s:%d", tsIP, portMap.In))
-	if err != nil {
-		return fmt.Errorf("failed to listen on DNS port %d: %w", portMap.In, err)
-	}
-	defer tsConn.Close()
-
-	slog.Info(fmt.Sprintf("listening at (DNS): %s:%d -> 127.0.0.1:%d", hostname, portMap.In, portMap.Out))
-
-	// Create upstream connection to localhost DNS
-	upstreamAddr := fmt.Sprintf("127.0.0.1:%d", portMap.Out)
-
-	// Buffer for DNS packets (DNS typically uses 512 bytes, but we'll support larger)
-	buffer := make([]byte, 4096)
-
-	for {
-		select {
-		case <-ctx.Done():
-			return nil
-		default:
-			// Set read deadline to allow context cancellation
-			slog.Debug("Waiting for DNS query...") //"
-			tsConn.SetReadDeadline(time.Now().Add(1 * time.Second))
-
-			n, clientAddr, err := tsConn.ReadFrom(buffer)
-			slog.Debug("DNS query received", "client", clientAddr, "size", n)
-			if err != nil {
-				if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
-					continue // timeout is expected, check context and retry
-				}
-				// Check if context was cancelled
-				if ctx.Err() != nil {
-					return nil
-				}
-				slog.Error("DNS read error", "error", err)
-				continue
-			}
-
-			// Forward to upstream DNS server
-			go handleDNSQuery(buffer[:n], clientAddr, tsConn, upstreamAddr)
-		}
-	}
-}
-
-// handleDNSQuery forwards a DNS query to upstream and sends response back
-func handleDNSQuery(query []byte, clientAddr net.Addr, tsConn net.PacketConn, upstreamAddr string) {
-	// Create connection to upstream DNS
-	upstreamConn, err := net.Dial("udp", upstreamAddr)
-	if err != nil {
-		slog.Error("failed to connect to upstream DNS", "error", err, "upstream", upstreamAddr)
-		return
-	}
-	defer upstreamConn.Close()
-
-	// Set deadlines
-	upstreamConn.SetDeadline(time.Now().Add(5 * time.Second))
-
-	// Send query to upstream
-	if _, err := upstreamConn.Write(query); err != nil {
-		slog.Error("failed to write to upstream DNS", "error", err)
-		return
-	}
-
-	// Read response from upstream
-	response := make([]byte, 4096)
-	n, err := upstreamConn.Read(response)
-	if err != nil {
-		slog.Error("failed to read from upstream DNS", "error", err)
-		return
-	}
-
-	// Send response back to client
-	if _, err := tsConn.WriteTo(response[:n], clientAddr); err != nil {
-		slog.Error("failed to write response to client", "error", err)
-		return
-	}
-
-	slog.Debug("DNS query handled", "client", clientAddr, "size", n)
-}
-
 // createReverseProxy creates a reverse proxy to the specified localhost port
 func createReverseProxy(port int) *httputil.ReverseProxy {
 	u, err := url.Parse(fmt.Sprintf("http://localhost:%d", port))
@@ -384,6 +698,14 @@ func createReverseProxy(port int) *httputil.ReverseProxy {
 	}
 
 	proxy := httputil.NewSingleHostReverseProxy(u)
+	proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		// a client that went away is not an upstream problem
+		if !errors.Is(err, context.Canceled) {
+			upstreamErrors.Add(upstreamLabels{Upstream: u.Host}, 1)
+		}
+		slog.Error("upstream request failed", "error", err, "upstream", u.Host)
+		w.WriteHeader(http.StatusBadGateway)
+	}
 	proxy.Transport = &http.Transport{
 		DialContext: (&net.Dialer{
 			Timeout: 2 * time.Second,
@@ -394,50 +716,189 @@ func createReverseProxy(port int) *httputil.ReverseProxy {
 	return proxy
 }
 
-// createWhoisHandler creates an HTTP handler that injects Tailscale user information
-func createWhoisHandler(lc *local.Client, proxy *httputil.ReverseProxy) http.HandlerFunc {
+// createListenerHandler creates the handler shared by the HTTP and HTTPS
+// listeners, forwarding to routes or the upstream on port. Requests are
+// counted in the metrics under the listener name.
+func createListenerHandler(lc *local.Client, listener string, port int, routes []Route) http.Handler {
+	handler := http.Handler(createWhoisHandler(lc, createUpstreamHandler(port, routes)))
+	if assertions != nil && *flagJWKSPath != "" {
+		handler = assertions.withJWKS(*flagJWKSPath, handler)
+	}
+	return instrumentHandler(listener, handler)
+}
+
+// createUpstreamHandler creates the handler that forwards requests to the
+// upstream. When routes are configured requests are sent to the matching
+// route and only fall back to the localhost port if no route matches.
+// Until the upstream is ready a "starting up" page is served instead.
+func createUpstreamHandler(port int, routes []Route) http.Handler {
+	var handler http.Handler = createReverseProxy(port)
+	if len(routes) > 0 {
+		handler = createRouter(routes, handler)
+	}
+	return upstreamReady.gate(handler)
+}
+
+// createWhoisHandler creates an HTTP handler that injects Tailscale user information.
+// Requests that arrived over Funnel have no tailnet identity and are marked
+// with the Tailscale-Funnel-Request header instead.
+// When an access policy is configured callers it rejects get a 403 page.
+func createWhoisHandler(lc *local.Client, proxy http.Handler) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		var ul, dn, pp string
-
-		who, err := lc.WhoIs(r.Context(), r.RemoteAddr)
-		if err != nil {
+		var nodeName, nodeTags, nodeID, nodeIP string
+		var who *apitype.WhoIsResponse
+
+		// the funnel header is always replaced so clients can not spoof it
+		r.Header.Del("Tailscale-Funnel-Request")
+
+		funnelSrc, isFunnel := funnelSource(r.Context())
+		if isFunnel {
+			// the remote address of a funnel connection is the funnel relay,
+			// use the public client address instead. There is no identity
+			// to look up for internet callers.
+			r.RemoteAddr = funnelSrc.String()
+			r.Header.Set("Tailscale-Funnel-Request", "true")
+		} else if whois, err := lc.WhoIs(r.Context(), r.RemoteAddr); err != nil {
 			slog.Error("whois lookup failed", "error", err, "remote", r.RemoteAddr)
-		} else if who.UserProfile != nil && who.UserProfile.LoginName != "tagged-devices" {
-			slog.Debug("set Tailscale-* headers",
-				slog.String("remote", r.RemoteAddr),
-				slog.String("id", who.UserProfile.ID.String()),
-			)
+			whoisFailures.Add(1)
+		} else {
+			who = whois
+			if who.UserProfile != nil && who.UserProfile.LoginName != "tagged-devices" {
+				slog.Debug("set Tailscale-* headers",
+					slog.String("remote", r.RemoteAddr),
+					slog.String("id", who.UserProfile.ID.String()),
+				)
+
+				ul = who.UserProfile.LoginName
+				dn = who.UserProfile.DisplayName
+				pp = who.UserProfile.ProfilePicURL
+			}
+		}
+
+		// node identity is set for every caller, including tagged devices
+		// which have no user, so services can authorize each other by tag
+		if who != nil && who.Node != nil {
+			nodeName = strings.TrimSuffix(who.Node.Name, ".")
+			nodeTags = strings.Join(who.Node.Tags, ",")
+			nodeID = string(who.Node.StableID)
+			if ap, err := netip.ParseAddrPort(r.RemoteAddr); err == nil {
+				nodeIP = ap.Addr().String()
+			}
+		}
 
-			ul = who.UserProfile.LoginName
-			dn = who.UserProfile.DisplayName
-			pp = who.UserProfile.ProfilePicURL
+		if info := requestInfoFrom(r.Context()); info != nil {
+			info.remote = r.RemoteAddr
+			info.login = ul
+			info.node = nodeName
+			info.funnel = isFunnel
 		}
 
 		// always populate the headers, even if blank for security reasons.
 		r.Header.Set("Tailscale-User-Login", ul)
 		r.Header.Set("Tailscale-User-Name", dn)
 		r.Header.Set("Tailscale-User-Profile-Pic", pp)
+		r.Header.Set("Tailscale-Node-Name", nodeName)
+		r.Header.Set("Tailscale-Node-Tags", nodeTags)
+		r.Header.Set("Tailscale-Node-ID", nodeID)
+		r.Header.Set("Tailscale-Node-IP", nodeIP)
+
+		// the assertion is only set when whois succeeded, and always removed
+		// first so clients can not spoof it
+		r.Header.Del("Tailscale-Identity-Assertion")
+		if assertions != nil && who != nil {
+			claims := assertionClaims{
+				Login:      ul,
+				Name:       dn,
+				ProfilePic: pp,
+				NodeName:   nodeName,
+				NodeID:     nodeID,
+				NodeIP:     nodeIP,
+			}
+			if who.Node != nil {
+				claims.Tags = who.Node.Tags
+			}
+			claims.Subject = ul
+			if claims.Subject == "" {
+				claims.Subject = nodeID
+			}
+
+			if token, err := assertions.sign(claims); err != nil {
+				slog.Error("failed to sign identity assertion", "error", err)
+			} else {
+				r.Header.Set("Tailscale-Identity-Assertion", token)
+			}
+		}
+
+		// the capabilities header is always replaced so clients can not spoof it
+		r.Header.Del("Tailscale-App-Capabilities")
+		if len(flagAppCaps) > 0 {
+			var capMap tailcfg.PeerCapMap
+			if who != nil {
+				capMap = who.CapMap
+			}
+			r.Header.Set("Tailscale-App-Capabilities", appCapabilitiesJSON(capMap, flagAppCaps))
+		}
+
+		if isFunnel && !funnelPathAllowed(r.URL.Path) {
+			slog.Info("funnel request denied", "remote", r.RemoteAddr, "path", r.URL.Path)
+			serveForbidden(w)
+			return
+		}
+
+		// Funnel callers have no identity to match, they are limited by
+		// -funnel-allow-path instead
+		if accessRules.enabled() && !isFunnel {
+			if ok, reason := accessRules.check(who); !ok {
+				slog.Info("access denied", "remote", r.RemoteAddr, "login", ul, "reason", reason)
+				serveForbidden(w)
+				return
+			}
+		}
 
 		proxy.ServeHTTP(w, r)
 	}
 }
 
+// appCapabilitiesJSON returns a JSON object of the named capabilities in
+// capMap, in the same format as `tailscale serve`. Capabilities the caller was
+// not granted are left out, so the result is "{}" when it has none of them.
+func appCapabilitiesJSON(capMap tailcfg.PeerCapMap, names []string) string {
+	caps := make(tailcfg.PeerCapMap)
+	for _, name := range names {
+		if values, ok := capMap[tailcfg.PeerCapability(name)]; ok {
+			caps[tailcfg.PeerCapability(name)] = values
+		}
+	}
+
+	b, err := json.Marshal(caps)
+	if err != nil {
+		slog.Error("failed to encode app capabilities", "error", err)
+		return "{}"
+	}
+	return string(b)
+}
+
 // attachLogging attaches logging to a command's stdout and stderr
 // and logs them to the slog logger.
+// The returned wait function blocks until all output has been logged and
+// must be called before cmd.Wait(), which closes the pipes.
 // It returns an error if it fails to attach the pipes.
-func attachLogging(cmd *exec.Cmd) error {
+func attachLogging(cmd *exec.Cmd) (wait func(), err error) {
 
 	stdoutPipe, err := cmd.StdoutPipe()
 	if err != nil {
-		return err
+		return nil, err
 	}
 	stderrPipe, err := cmd.StderrPipe()
 	if err != nil {
-		return err
+		return nil, err
 	}
 
+	var wg sync.WaitGroup
+
 	// log stdout
-	go func() {
+	wg.Go(func() {
 		scanner := bufio.NewScanner(stdoutPipe)
 		for scanner.Scan() {
 			slog.Info(fmt.Sprintf("cmd > %s", scanner.Text()))
@@ -445,10 +906,10 @@ func attachLogging(cmd *exec.Cmd) error {
 		if err := scanner.Err(); err != nil {
 			slog.Error("reading stdout failed", "error", err)
 		}
-	}()
+	})
 
 	// log stderr
-	go func() {
+	wg.Go(func() {
 		scanner := bufio.NewScanner(stderrPipe)
 		for scanner.Scan() {
 			slog.Info(fmt.Sprintf("cmd stderr> %s", scanner.Text()))
@@ -456,9 +917,9 @@ func attachLogging(cmd *exec.Cmd) error {
 		if err := scanner.Err(); err != nil {
 			slog.Error("reading stderr failed", "error", err)
 		}
-	}()
+	})
 
-	return nil
+	return wg.Wait, nil
 }
 
 type PortMapFlag struct {
@@ -493,6 +954,10 @@ func (p *PortMapFlag) Set(value string) error {
 	p.isSet = true
 
 	if value == "" {
+		// flags without a default, such as -tcp, need a port
+		if p.defaultIn == 0 || p.defaultOut == 0 {
+			return fmt.Errorf("a port mapping is required, expected in:out or port")
+		}
 		p.In = p.defaultIn
 		p.Out = p.defaultOut
 		return nil
@@ -521,6 +986,51 @@ func (p *PortMapFlag) Set(value string) error {
 		}
 		p.In = inPort
 		p.Out = outPort
+
+	} else {
+		return fmt.Errorf("invalid port mapping format, expected in:out or port: %s", value)
+	}
+
+	if p.In < 1 || p.In > 65535 || p.Out < 1 || p.Out > 65535 {
+		return fmt.Errorf("port out of range (1-65535): %s", value)
+	}
+	return nil
+}
+
+// PortMapListFlag is a repeatable flag where each value is parsed as a PortMapFlag
+type PortMapListFlag struct {
+	Maps []*PortMapFlag
+
+	defaultIn  int
+	defaultOut int
+}
+
+// NewPortMapListFlag creates a new PortMapListFlag with default in/out ports
+// applied to each mapping
+func NewPortMapListFlag(in, out int) *PortMapListFlag {
+	return &PortMapListFlag{
+		defaultIn:  in,
+		defaultOut: out,
+	}
+}
+
+func (p *PortMapListFlag) String() string {
+	parts := make([]string, len(p.Maps))
+	for i, m := range p.Maps {
+		parts[i] = m.String()
+	}
+	return strings.Join(parts, ",")
+}
+
+func (p *PortMapListFlag) IsSet() bool {
+	return len(p.Maps) > 0
+}
+
+func (p *PortMapListFlag) Set(value string) error {
+	m := NewPortMapFlag(p.defaultIn, p.defaultOut)
+	if err := m.Set(value); err != nil {
+		return err
 	}
+	p.Maps = append(p.Maps, m)
 	return nil
 }
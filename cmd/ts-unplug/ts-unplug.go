@@ -4,6 +4,7 @@ import (
 	"context"
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"log/slog"
 	"net"
@@ -11,7 +12,10 @@ import (
 	"net/http/httputil"
 	"net/url"
 	"os"
+	"sync"
+	"time"
 
+	"github.com/mostlygeek/ts-plug/internal/tsauth"
 	"tailscale.com/tsnet"
 )
 
@@ -20,6 +24,13 @@ var (
 	flagHostname   = flag.String("hostname", "tsunplug", "hostname for the tsnet server")
 	flagDebugTSNet = flag.Bool("debug-tsnet", false, "enable tsnet.Server logging")
 	flagPort       = flag.Int("port", 80, "local port to listen on")
+	flagMode       = flag.String("mode", "http", "proxy mode (http | tcp)")
+
+	// node registration flags
+	flagAuthKey       = flag.String("authkey", "", "auth key to register the node (default $TS_AUTHKEY)")
+	flagClientSecret  = flag.String("client-secret", "", "OAuth client secret used to create an auth key, requires -advertise-tags (default $TS_CLIENT_SECRET)")
+	flagAdvertiseTags = flag.String("advertise-tags", "", "comma separated ACL tags to request for the node (tag:a,tag:b)")
+	flagControlURL    = flag.String("control-url", "", "coordination server URL, for self-hosted control servers such as Headscale")
 )
 
 func main() {
@@ -30,6 +41,11 @@ func main() {
 		os.Exit(1)
 	}
 
+	if *flagMode != "http" && *flagMode != "tcp" {
+		slog.Error("unknown mode", slog.String("mode", *flagMode))
+		os.Exit(1)
+	}
+
 	args := flag.Args()
 	if len(args) < 1 {
 		slog.Error("remote-addr is required as first positional argument")
@@ -38,17 +54,40 @@ func main() {
 
 	remoteAddr := args[0]
 
-	// Ensure remoteAddr has a port, default to 80 if not specified
+	// Ensure remoteAddr has a port. HTTP defaults to 80, a TCP service has
+	// no usual port so it must be given.
 	if _, _, err := net.SplitHostPort(remoteAddr); err != nil {
+		if *flagMode == "tcp" {
+			slog.Error("remote-addr must include a port in tcp mode", slog.String("remote", remoteAddr))
+			os.Exit(1)
+		}
 		remoteAddr = net.JoinHostPort(remoteAddr, "80")
 	}
 
+	if err := tsauth.ValidateControlURL(*flagControlURL); err != nil {
+		slog.Error("invalid control URL", slog.Any("error", err))
+		os.Exit(1)
+	}
+	tags, err := tsauth.ParseTags(*flagAdvertiseTags)
+	if err != nil {
+		slog.Error("invalid advertise tags", slog.Any("error", err))
+		os.Exit(1)
+	}
+	authKey, err := tsauth.ResolveAuthKey(*flagAuthKey, *flagClientSecret, tags)
+	if err != nil {
+		slog.Error("invalid auth configuration", slog.Any("error", err))
+		os.Exit(1)
+	}
+
 	ctx, cancelCtx := context.WithCancel(context.Background())
 	defer cancelCtx()
 
 	ts := &tsnet.Server{
-		Hostname: *flagHostname,
-		Dir:      *flagDir,
+		Hostname:      *flagHostname,
+		Dir:           *flagDir,
+		AuthKey:       authKey,
+		AdvertiseTags: tags,
+		ControlURL:    *flagControlURL,
 	}
 
 	if *flagDebugTSNet {
@@ -68,6 +107,22 @@ func main() {
 
 	slog.Info("tsnet server started", slog.String("status", st.BackendState))
 
+	listenAddr := fmt.Sprintf("localhost:%d", *flagPort)
+	listener, err := net.Listen("tcp", listenAddr)
+	if err != nil {
+		slog.Error("failed to listen", slog.String("addr", listenAddr), slog.Any("error", err))
+		os.Exit(1)
+	}
+	defer listener.Close()
+
+	if *flagMode == "tcp" {
+		slog.Info("TCP proxy listening", slog.String("local", listenAddr), slog.String("remote", remoteAddr))
+		if err := serveTCP(ctx, ts, listener, remoteAddr); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	target, err := url.Parse("http://" + remoteAddr)
 	if err != nil {
 		slog.Error("invalid remote address", slog.Any("error", err))
@@ -81,17 +136,68 @@ func main() {
 		},
 	}
 
-	listenAddr := fmt.Sprintf("localhost:%d", *flagPort)
-	listener, err := net.Listen("tcp", listenAddr)
-	if err != nil {
-		slog.Error("failed to listen", slog.String("addr", listenAddr), slog.Any("error", err))
-		os.Exit(1)
-	}
-	defer listener.Close()
-
 	slog.Info("HTTP proxy listening", slog.String("local", listenAddr), slog.String("remote", remoteAddr))
 
 	if err := http.Serve(listener, proxy); err != nil {
 		log.Fatal(err)
 	}
 }
+
+// serveTCP accepts local connections and pipes each one to remoteAddr
+// over the tailnet
+func serveTCP(ctx context.Context, ts *tsnet.Server, listener net.Listener, remoteAddr string) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return fmt.Errorf("accept failed: %w", err)
+		}
+		go handleTCPConn(ctx, ts, conn, remoteAddr)
+	}
+}
+
+// handleTCPConn dials remoteAddr over the tailnet and copies bytes in both
+// directions until both sides are done
+func handleTCPConn(ctx context.Context, ts *tsnet.Server, conn net.Conn, remoteAddr string) {
+	defer conn.Close()
+
+	start := time.Now()
+	client := conn.RemoteAddr().String()
+
+	remoteConn, err := ts.Dial(ctx, "tcp", remoteAddr)
+	if err != nil {
+		slog.Error("failed to dial remote", slog.String("client", client), slog.String("remote", remoteAddr), slog.Any("error", err))
+		return
+	}
+	defer remoteConn.Close()
+
+	slog.Info("connection opened", slog.String("client", client), slog.String("remote", remoteAddr))
+
+	var sent, received int64
+	var wg sync.WaitGroup
+	wg.Go(func() { sent = copyHalf(remoteConn, conn) })
+	wg.Go(func() { received = copyHalf(conn, remoteConn) })
+	wg.Wait()
+
+	slog.Info("connection closed",
+		slog.String("client", client),
+		slog.String("remote", remoteAddr),
+		slog.Int64("sent", sent),
+		slog.Int64("received", received),
+		slog.Duration("duration", time.Since(start)),
+	)
+}
+
+// copyHalf copies src to dst then closes the write side of dst so the
+// peer sees the half-close. It returns the number of bytes copied.
+func copyHalf(dst, src net.Conn) int64 {
+	n, err := io.Copy(dst, src)
+	if err != nil {
+		slog.Debug("copy ended", slog.Any("error", err))
+	}
+	if cw, ok := dst.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+	} else {
+		dst.Close()
+	}
+	return n
+}
@@ -0,0 +1,70 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+// Package tsauth holds the tailnet registration settings shared by ts-plug
+// and ts-unplug.
+package tsauth
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// ParseTags parses a comma separated list of ACL tags
+func ParseTags(value string) ([]string, error) {
+	if value == "" {
+		return nil, nil
+	}
+
+	var tags []string
+	for tag := range strings.SplitSeq(value, ",") {
+		tag = strings.TrimSpace(tag)
+		if !strings.HasPrefix(tag, "tag:") || len(tag) == len("tag:") {
+			return nil, fmt.Errorf("invalid tag %q, tags must be in the format tag:name", tag)
+		}
+		tags = append(tags, tag)
+	}
+	return tags, nil
+}
+
+// ValidateControlURL checks that a -control-url value is an absolute http or
+// https URL. An empty value selects the default control server.
+func ValidateControlURL(value string) error {
+	if value == "" {
+		return nil
+	}
+	u, err := url.ParseRequestURI(value)
+	if err != nil {
+		return err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid control URL %q, must be an http or https URL", value)
+	}
+	return nil
+}
+
+// ResolveAuthKey returns the key used to register the node. An OAuth client
+// secret is returned as is, tsnet exchanges it for an auth key carrying the
+// advertised tags. An empty key lets tsnet fall back to $TS_AUTHKEY.
+func ResolveAuthKey(authKey, clientSecret string, tags []string) (string, error) {
+	if clientSecret == "" {
+		clientSecret = os.Getenv("TS_CLIENT_SECRET")
+	}
+	if clientSecret == "" {
+		return authKey, nil
+	}
+
+	if authKey != "" {
+		return "", errors.New("an auth key and an OAuth client secret can not be used together")
+	}
+	if !strings.HasPrefix(clientSecret, "tskey-client-") {
+		return "", errors.New("OAuth client secret must start with tskey-client-")
+	}
+	if len(tags) == 0 {
+		return "", errors.New("an OAuth client secret requires -advertise-tags")
+	}
+	return clientSecret, nil
+}
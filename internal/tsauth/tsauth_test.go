@@ -0,0 +1,61 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package tsauth
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestParseTags(t *testing.T) {
+	tags, err := ParseTags("tag:web, tag:prod")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"tag:web", "tag:prod"}; !slices.Equal(tags, want) {
+		t.Errorf("ParseTags = %v, want %v", tags, want)
+	}
+	for _, bad := range []string{"web", "tag:", "tag:web,,tag:prod"} {
+		if _, err := ParseTags(bad); err == nil {
+			t.Errorf("ParseTags(%q) succeeded, want error", bad)
+		}
+	}
+}
+
+func TestResolveAuthKey(t *testing.T) {
+	t.Setenv("TS_CLIENT_SECRET", "")
+	tags := []string{"tag:web"}
+
+	tests := []struct {
+		authKey, secret string
+		tags            []string
+		want            string
+		wantErr         bool
+	}{
+		{authKey: "tskey-auth-abc", want: "tskey-auth-abc"},
+		{secret: "tskey-client-abc", tags: tags, want: "tskey-client-abc"},
+		{authKey: "tskey-auth-abc", secret: "tskey-client-abc", tags: tags, wantErr: true},
+		{secret: "tskey-auth-abc", tags: tags, wantErr: true},
+		{secret: "tskey-client-abc", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ResolveAuthKey(tt.authKey, tt.secret, tt.tags)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("ResolveAuthKey(%q, %q, %v) = %q, %v", tt.authKey, tt.secret, tt.tags, got, err)
+		}
+	}
+}
+
+func TestValidateControlURL(t *testing.T) {
+	for _, good := range []string{"", "https://headscale.example.com", "http://127.0.0.1:8080/"} {
+		if err := ValidateControlURL(good); err != nil {
+			t.Errorf("ValidateControlURL(%q): %v", good, err)
+		}
+	}
+	for _, bad := range []string{"headscale.example.com", "/control", "ftp://example.com", "https://"} {
+		if err := ValidateControlURL(bad); err == nil {
+			t.Errorf("ValidateControlURL(%q) succeeded, want error", bad)
+		}
+	}
+}